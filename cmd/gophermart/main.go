@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/Schera-ole/loyalty_system/internal/accrual"
 	"github.com/Schera-ole/loyalty_system/internal/config"
 	"github.com/Schera-ole/loyalty_system/internal/handler"
+	"github.com/Schera-ole/loyalty_system/internal/health"
+	"github.com/Schera-ole/loyalty_system/internal/jobs"
 	"github.com/Schera-ole/loyalty_system/internal/migration"
 	"github.com/Schera-ole/loyalty_system/internal/repository"
+	"github.com/Schera-ole/loyalty_system/internal/repository/memstore"
+	"github.com/Schera-ole/loyalty_system/internal/repository/sqlitestore"
 	"github.com/Schera-ole/loyalty_system/internal/service"
 	"go.uber.org/zap"
 )
@@ -29,41 +37,112 @@ func main() {
 	defer logger.Sync()
 	logSugar := logger.Sugar()
 
-	// Check migrations
-	migCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	err = migration.RunMigrations(migCtx, systemConfig.DatabaseURI, logSugar)
-	if err != nil {
-		logSugar.Errorf("%v", err)
-	}
+	// Initialize storage: postgres (the default, durable), sqlite for a
+	// single-node deploy or local development, or an in-memory memstore for
+	// tests and demos.
+	var repo repository.Repository
+	switch systemConfig.StorageBackend {
+	case "memory":
+		repo = memstore.New()
+		logSugar.Infow("Using in-memory storage backend")
+	case "sqlite":
+		// sqlitestore.New migrates on its own connection pool: a separate
+		// throwaway connection here would leave a ":memory:" DSN's tables
+		// gone by the time the pool below opens its own connection to it.
+		sqliteStorage, err := sqlitestore.New(systemConfig.DatabaseURI)
+		if err != nil {
+			log.Fatal("Failed to open sqlite database: ", err)
+		}
+		repo = sqliteStorage
+	case "postgres", "":
+		migCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := migration.RunMigrations(migCtx, systemConfig.DatabaseURI, logSugar); err != nil {
+			logSugar.Errorf("%v", err)
+		}
+		cancel()
 
-	// Initialize database storage
-	dbStorage, err := repository.NewDBStorage(systemConfig.DatabaseURI)
-	if err != nil {
-		log.Fatal("Failed to connect to database: ", err)
+		dbStorage, err := repository.NewDBStorage(systemConfig.DatabaseURI)
+		if err != nil {
+			log.Fatal("Failed to connect to database: ", err)
+		}
+		repo = dbStorage
+	default:
+		log.Fatal("Unknown storage backend: ", systemConfig.StorageBackend)
 	}
-	defer dbStorage.Close()
+	defer repo.Close()
 
 	// Initialize service
-	loyaltyService := service.NewLoyaltySystemService(dbStorage, logSugar)
+	loyaltyService := service.NewLoyaltySystemService(repo, logSugar)
 
 	ctx := context.Background()
-	if err := dbStorage.Ping(ctx); err != nil {
-		log.Fatal("Failed to ping database: ", err)
+	if err := repo.Ping(ctx); err != nil {
+		log.Fatal("Failed to ping storage backend: ", err)
 	}
 
 	logSugar.Infow(
 		"Starting server",
 		"run address", systemConfig.RunAddress,
 		"accural system address", systemConfig.AccrualAddress,
-		"database", systemConfig.DatabaseURI,
+		"storage backend", systemConfig.StorageBackend,
 	)
 
-	// Start server
-	logSugar.Fatal(
-		http.ListenAndServe(
-			systemConfig.RunAddress,
-			handler.Router(logSugar, systemConfig, loyaltyService),
-		),
+	// Start the accrual-poll worker pool. It claims due rows from
+	// accrual_poll_jobs, so polling survives a restart of this process.
+	accrualClient, err := accrual.NewClient(
+		systemConfig.AccrualAddress,
+		systemConfig.AccrualCircuitFailureThreshold,
+		systemConfig.AccrualCircuitCooldown,
+		accrual.TLSConfig{
+			CertFile:     systemConfig.AccrualClientCertFile,
+			KeyFile:      systemConfig.AccrualClientKeyFile,
+			ServerCAFile: systemConfig.AccrualServerCAFile,
+		},
 	)
+	if err != nil {
+		log.Fatal("Failed to initialize accrual client: ", err)
+	}
+	pollWorker := jobs.NewWorker(repo, accrualClient, systemConfig.JobsBackoffBase, systemConfig.JobsMaxAttempts, systemConfig.AccrualCircuitCooldown, systemConfig.JobsBatchSize, logSugar)
+	go pollWorker.Run(ctx, systemConfig.JobsPoolSize)
+
+	// Start the background health probe backing /healthz and /readyz.
+	healthChecker := health.NewChecker(repo, systemConfig.HealthCheckInterval, systemConfig.AccrualAddress, systemConfig.HealthCheckAccrualProbe, logSugar)
+	go healthChecker.Run(ctx)
+
+	// Start server. With TLSCertFile/TLSKeyFile set, the listener accepts an
+	// optional client certificate verified against ClientCAFile (mTLS);
+	// whether one is actually required is a per-route decision left to
+	// handler.RequireJWTOrClientCert, not the listener - most routes (login,
+	// register, OAuth, health checks) still need to work for plain TLS
+	// clients with no certificate at all.
+	router := handler.Router(logSugar, systemConfig, loyaltyService, healthChecker)
+	if systemConfig.TLSCertFile != "" && systemConfig.TLSKeyFile != "" {
+		clientCAs, err := loadClientCAs(systemConfig.ClientCAFile)
+		if err != nil {
+			log.Fatal("Failed to load client CA bundle: ", err)
+		}
+
+		server := &http.Server{
+			Addr:    systemConfig.RunAddress,
+			Handler: router,
+			TLSConfig: &tls.Config{
+				ClientAuth: tls.VerifyClientCertIfGiven,
+				ClientCAs:  clientCAs,
+			},
+		}
+		logSugar.Fatal(server.ListenAndServeTLS(systemConfig.TLSCertFile, systemConfig.TLSKeyFile))
+	}
+
+	logSugar.Fatal(http.ListenAndServe(systemConfig.RunAddress, router))
+}
+
+func loadClientCAs(clientCAFile string) (*x509.CertPool, error) {
+	caCert, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, os.ErrInvalid
+	}
+	return pool, nil
 }
@@ -0,0 +1,168 @@
+// Package accrual provides a client for the external loyalty accrual system,
+// with request-scoped context propagation, connection reuse, and a circuit
+// breaker so a hard-down accrual system doesn't pile up blocked requests.
+package accrual
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/model"
+)
+
+// ErrCircuitOpen is returned by GetOrder while the breaker is open, without
+// making a request.
+var ErrCircuitOpen = errors.New("accrual: circuit open")
+
+// ErrOrderNotRegistered is returned when the accrual system has not yet
+// registered the order (HTTP 204).
+var ErrOrderNotRegistered = errors.New("accrual: order not registered")
+
+// RateLimitedError is returned when the accrual system responds 429, with
+// the Retry-After duration it asked for.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("accrual: rate limited, retry after %s", e.RetryAfter)
+}
+
+// Client talks to the accrual system over HTTP, guarded by a circuit
+// breaker keyed on consecutive failures.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	breaker    *circuitBreaker
+}
+
+// TLSConfig holds the mTLS material for dialing the accrual system.
+// CertFile/KeyFile are the client's own certificate and key; ServerCAFile
+// verifies the accrual system's server certificate. All three must be set
+// to enable mTLS; NewClient falls back to plain HTTP/HTTPS otherwise.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ServerCAFile string
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" && c.KeyFile != "" && c.ServerCAFile != ""
+}
+
+// NewClient builds a Client against baseURL. failureThreshold consecutive
+// failures trip the breaker open for cooldown before a half-open probe is
+// allowed through. When tlsConfig is enabled, requests are made over mTLS
+// using the given client certificate and server CA.
+func NewClient(baseURL string, failureThreshold int, cooldown time.Duration, tlsConfig TLSConfig) (*Client, error) {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if tlsConfig.enabled() {
+		clientCert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("accrual: loading client certificate: %w", err)
+		}
+
+		caCert, err := os.ReadFile(tlsConfig.ServerCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("accrual: reading server CA: %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("accrual: no certificates found in %s", tlsConfig.ServerCAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      caPool,
+		}
+	}
+
+	return &Client{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+		},
+		breaker: newCircuitBreaker(failureThreshold, cooldown),
+	}, nil
+}
+
+// NewClientWithHTTPClient builds a Client using a caller-provided *http.Client,
+// bypassing the usual Transport construction. This exists for tests that need
+// to swap in a recording/replaying RoundTripper (e.g. go-vcr) without
+// touching the network.
+func NewClientWithHTTPClient(baseURL string, failureThreshold int, cooldown time.Duration, httpClient *http.Client) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: httpClient,
+		breaker:    newCircuitBreaker(failureThreshold, cooldown),
+	}
+}
+
+// GetOrder fetches the accrual status of orderNumber. ctx should be derived
+// from the caller's (e.g. a poll job's) context, not context.Background.
+func (c *Client) GetOrder(ctx context.Context, orderNumber string) (model.AccrualResponse, error) {
+	if !c.breaker.Allow() {
+		return model.AccrualResponse{}, ErrCircuitOpen
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+orderNumber, nil)
+	if err != nil {
+		c.breaker.RecordFailure()
+		return model.AccrualResponse{}, fmt.Errorf("error building accrual request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		c.breaker.RecordFailure()
+		return model.AccrualResponse{}, fmt.Errorf("error calling accrual system: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var out model.AccrualResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			c.breaker.RecordFailure()
+			return model.AccrualResponse{}, fmt.Errorf("error decoding accrual response: %w", err)
+		}
+		c.breaker.RecordSuccess()
+		return out, nil
+
+	case http.StatusNoContent:
+		c.breaker.RecordSuccess()
+		return model.AccrualResponse{}, ErrOrderNotRegistered
+
+	case http.StatusTooManyRequests:
+		c.breaker.RecordSuccess()
+		retryAfter := 60 * time.Second
+		if header := resp.Header.Get("Retry-After"); header != "" {
+			if seconds, err := strconv.Atoi(header); err == nil {
+				retryAfter = time.Duration(seconds) * time.Second
+			} else if when, err := http.ParseTime(header); err == nil {
+				retryAfter = time.Until(when)
+			}
+		}
+		return model.AccrualResponse{}, &RateLimitedError{RetryAfter: retryAfter}
+
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		c.breaker.RecordFailure()
+		return model.AccrualResponse{}, fmt.Errorf("accrual: server error %d", resp.StatusCode)
+
+	default:
+		c.breaker.RecordFailure()
+		return model.AccrualResponse{}, fmt.Errorf("accrual: unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnConfig configures the relying party used for passkey/hardware-key
+// registration and login ceremonies.
+type WebAuthnConfig struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigin      string
+}
+
+// NewWebAuthn builds the relying party that drives registration and
+// assertion ceremonies.
+func NewWebAuthn(cfg WebAuthnConfig) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     []string{cfg.RPOrigin},
+	})
+}
+
+// WebAuthnUser adapts a loyalty_system username and its bound credentials to
+// the webauthn.User interface the ceremonies operate on.
+type WebAuthnUser struct {
+	Username    string
+	Credentials []model.WebAuthnCredential
+}
+
+func (u WebAuthnUser) WebAuthnID() []byte          { return []byte(u.Username) }
+func (u WebAuthnUser) WebAuthnName() string        { return u.Username }
+func (u WebAuthnUser) WebAuthnDisplayName() string { return u.Username }
+func (u WebAuthnUser) WebAuthnIcon() string        { return "" }
+
+func (u WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Credentials))
+	for i, cred := range u.Credentials {
+		transports := make([]protocol.AuthenticatorTransport, len(cred.Transports))
+		for j, t := range cred.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+		credentials[i] = webauthn.Credential{
+			ID:        cred.CredentialID,
+			PublicKey: cred.PublicKey,
+			Transport: transports,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    cred.AAGUID,
+				SignCount: cred.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+// CredentialFromWebAuthn converts a freshly-enrolled library credential into
+// the shape stored in webauthn_credentials.
+func CredentialFromWebAuthn(cred *webauthn.Credential) model.WebAuthnCredential {
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	return model.WebAuthnCredential{
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    cred.Authenticator.SignCount,
+		AAGUID:       cred.Authenticator.AAGUID,
+		Transports:   transports,
+	}
+}
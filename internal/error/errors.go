@@ -14,4 +14,11 @@ var (
 	ErrDatabaseOperation       = errors.New("database operation failed")
 	ErrBalanceNotFound         = errors.New("user balance not found")
 	ErrInsufficientFunds       = errors.New("insufficient funds")
+	ErrWebAuthnSessionNotFound = errors.New("webauthn session not found")
+	ErrPayloadTooLarge         = errors.New("request payload too large")
+	ErrInvalidUsername         = errors.New("invalid username format")
+	ErrRefreshTokenNotFound    = errors.New("refresh token not found")
+	ErrRefreshTokenExpired     = errors.New("refresh token expired")
+	ErrRefreshTokenReused      = errors.New("refresh token already used")
+	ErrFederatedIdentityLinked = errors.New("federated identity already linked to another account")
 )
@@ -1,28 +1,140 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/Schera-ole/loyalty_system/internal/auth"
 	"github.com/Schera-ole/loyalty_system/internal/config"
 	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/health"
 	appmiddleware "github.com/Schera-ole/loyalty_system/internal/middleware"
 	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/Schera-ole/loyalty_system/internal/render"
 	"github.com/Schera-ole/loyalty_system/internal/service"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/jwtauth/v5"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+const (
+	// maxSmallJSONBodyBytes caps the wire size of the small fixed-shape JSON
+	// bodies these routes accept (credentials, a withdrawal request).
+	maxSmallJSONBodyBytes = 1 << 10 // 1 KiB
+	// maxOrderBodyBytes caps /api/user/orders: its body is just a short
+	// digit string, the order number.
+	maxOrderBodyBytes = 64
+	// maxWebAuthnBodyBytes caps the webauthn ceremony routes, whose bodies
+	// carry an attestation/assertion object (public key, signature, and for
+	// some authenticators a certificate chain) larger than a plain JSON body
+	// but still bounded.
+	maxWebAuthnBodyBytes = 16 << 10 // 16 KiB
+	// usernameValidateRateLimit caps /api/user/validate per IP per minute,
+	// so it can't be hammered into a user-enumeration oracle.
+	usernameValidateRateLimit = 10
+)
+
+// refreshTokenCookie holds the opaque refresh token issued alongside an
+// access JWT; unlike the access token it is never put in the Authorization
+// header, since it's only ever redeemed by this API, not sent to other
+// services the client talks to.
+const refreshTokenCookie = "refresh_token"
+
+// issueAuthTokens mints a short-lived access JWT plus the opaque refresh
+// token backing it, persists the refresh session, and writes both to the
+// response. It's the single place SignUpHandler, SignInHandler,
+// WebAuthnLoginFinishHandler and OAuthCallbackHandler mint a session, so a
+// login path can't accidentally skip refresh-token issuance.
+func issueAuthTokens(r *http.Request, w http.ResponseWriter, lss *service.LoyaltySystemService, tokenAuth *jwtauth.JWTAuth, username string) (string, error) {
+	jti := uuid.NewString()
+	_, accessToken, err := tokenAuth.Encode(map[string]interface{}{
+		"user_id": username,
+		"jti":     jti,
+		"exp":     time.Now().Add(service.AccessTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	refreshToken, err := lss.IssueRefreshSession(r.Context(), username, jti, r.UserAgent(), requestIP(r))
+	if err != nil {
+		return "", err
+	}
+
+	setAuthCookies(w, accessToken, refreshToken)
+	return accessToken, nil
+}
+
+// setAuthCookies writes the access token to both the Authorization header
+// and a cookie (for clients that can't set headers), and the refresh token
+// to its own HttpOnly cookie.
+func setAuthCookies(w http.ResponseWriter, accessToken string, refreshToken string) {
+	w.Header().Set("Authorization", "Bearer "+accessToken)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    accessToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(service.RefreshTokenTTL.Seconds()),
+	})
+}
+
+// clearAuthCookies expires both auth cookies, for logout.
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
+// requestIP extracts the client IP from the request's remote address, for
+// audit fields like RefreshSession.IP.
+func requestIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func Router(
 	logger *zap.SugaredLogger,
 	config *config.SystemConfig,
 	LSService *service.LoyaltySystemService,
+	healthChecker *health.Checker,
 ) chi.Router {
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
 	router.Use(middleware.StripSlashes)
 	router.Use(appmiddleware.LoggingMiddleware(logger))
 	router.Use(appmiddleware.GzipMiddleware)
@@ -31,24 +143,73 @@ func Router(
 	// JWT token authentication setup
 	tokenAuth := jwtauth.New(config.JwtAlgorithm, []byte(config.JwtSecretKey), nil)
 
+	// WebAuthn relying party for passkey/hardware-key registration and login
+	webAuthnRP, err := auth.NewWebAuthn(auth.WebAuthnConfig{
+		RPID:          config.WebAuthnRPID,
+		RPDisplayName: config.WebAuthnRPDisplayName,
+		RPOrigin:      config.WebAuthnRPOrigin,
+	})
+	if err != nil {
+		logger.Fatalw("Failed to initialize WebAuthn relying party", "error", err)
+	}
+
+	// OAuth2/OIDC social login providers, keyed by provider name. Absent from
+	// config.OAuthProviders means absent from this map, and its routes 404.
+	oauthProviders := make(map[string]*auth.OAuthProvider, len(config.OAuthProviders))
+	for name, providerCfg := range config.OAuthProviders {
+		provider, err := auth.NewOAuthProvider(context.Background(), name, providerCfg)
+		if err != nil {
+			logger.Fatalw("Failed to initialize OAuth provider", "provider", name, "error", err)
+		}
+		oauthProviders[name] = provider
+	}
+
 	// Public routes
 	router.Group(func(r chi.Router) {
-		r.Post("/api/user/register", func(w http.ResponseWriter, r *http.Request) {
+		r.With(appmiddleware.MaxBytesMiddleware(maxSmallJSONBodyBytes)).Post("/api/user/register", func(w http.ResponseWriter, r *http.Request) {
 			SignUpHandler(w, r, logger, LSService, tokenAuth)
 		})
-		r.Post("/api/user/login", func(w http.ResponseWriter, r *http.Request) {
+		r.With(appmiddleware.RateLimitMiddleware(usernameValidateRateLimit, time.Minute)).Get("/api/user/validate", func(w http.ResponseWriter, r *http.Request) {
+			ValidateUsernameHandler(w, r, logger, LSService)
+		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxSmallJSONBodyBytes)).Post("/api/user/login", func(w http.ResponseWriter, r *http.Request) {
 			SignInHandler(w, r, logger, LSService, tokenAuth)
 		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxWebAuthnBodyBytes)).Post("/api/user/webauthn/login/begin", func(w http.ResponseWriter, r *http.Request) {
+			WebAuthnLoginBeginHandler(w, r, logger, LSService, webAuthnRP)
+		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxWebAuthnBodyBytes)).Post("/api/user/webauthn/login/finish", func(w http.ResponseWriter, r *http.Request) {
+			WebAuthnLoginFinishHandler(w, r, logger, LSService, webAuthnRP, tokenAuth)
+		})
+		r.Get("/api/user/oauth/{provider}/login", func(w http.ResponseWriter, r *http.Request) {
+			OAuthLoginHandler(w, r, logger, oauthProviders)
+		})
+		r.Get("/api/user/oauth/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+			OAuthCallbackHandler(w, r, logger, LSService, oauthProviders, tokenAuth)
+		})
+		r.Get("/healthz", HealthzHandler(healthChecker))
+		r.Get("/readyz", ReadyzHandler(healthChecker))
+		r.With(appmiddleware.MaxBytesMiddleware(maxSmallJSONBodyBytes)).Post("/api/user/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+			TokenRefreshHandler(w, r, logger, LSService, tokenAuth)
+		})
 	})
 
-	// Protected routes - require JWT authentication
+	// Protected routes - require JWT authentication, or a verified mTLS
+	// client certificate for bouncer-style service callers
 	router.Group(func(r chi.Router) {
-		// JWT middleware - verifies token from Authorization header
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(jwtauth.Authenticator(tokenAuth))
+		r.Use(RequireJWTOrClientCert(tokenAuth, LSService))
 
-		r.Post("/api/user/orders", func(w http.ResponseWriter, r *http.Request) {
-			SendOrderHandler(w, r, logger, LSService, config)
+		r.Post("/api/user/logout", func(w http.ResponseWriter, r *http.Request) {
+			LogoutHandler(w, r, logger, LSService)
+		})
+		r.Get("/api/user/sessions", func(w http.ResponseWriter, r *http.Request) {
+			ListSessionsHandler(w, r, logger, LSService)
+		})
+		r.Delete("/api/user/sessions/{jti}", func(w http.ResponseWriter, r *http.Request) {
+			RevokeSessionHandler(w, r, logger, LSService)
+		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxOrderBodyBytes)).Post("/api/user/orders", func(w http.ResponseWriter, r *http.Request) {
+			SendOrderHandler(w, r, logger, LSService)
 		})
 		r.Get("/api/user/orders", func(w http.ResponseWriter, r *http.Request) {
 			GetOrdersHandler(w, r, logger, LSService)
@@ -56,33 +217,42 @@ func Router(
 		r.Get("/api/user/balance", func(w http.ResponseWriter, r *http.Request) {
 			GetBalanceHandler(w, r, logger, LSService)
 		})
-		r.Post("/api/user/balance/withdraw", func(w http.ResponseWriter, r *http.Request) {
+		r.With(appmiddleware.MaxBytesMiddleware(maxSmallJSONBodyBytes)).Post("/api/user/balance/withdraw", func(w http.ResponseWriter, r *http.Request) {
 			WithdrawPointsHandler(w, r, logger, LSService)
 		})
 		r.Get("/api/user/withdrawals", func(w http.ResponseWriter, r *http.Request) {
 			GetWithdrawalsHandler(w, r, logger, LSService)
 		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxWebAuthnBodyBytes)).Post("/api/user/webauthn/register/begin", func(w http.ResponseWriter, r *http.Request) {
+			WebAuthnRegisterBeginHandler(w, r, logger, LSService, webAuthnRP)
+		})
+		r.With(appmiddleware.MaxBytesMiddleware(maxWebAuthnBodyBytes)).Post("/api/user/webauthn/register/finish", func(w http.ResponseWriter, r *http.Request) {
+			WebAuthnRegisterFinishHandler(w, r, logger, LSService, webAuthnRP)
+		})
+		r.Get("/api/user/oauth/{provider}/link", func(w http.ResponseWriter, r *http.Request) {
+			OAuthLinkHandler(w, r, logger, oauthProviders)
+		})
 	})
 
 	return router
 }
 
-func SendOrderHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, config *config.SystemConfig) {
+func SendOrderHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService) {
 	body, err := HandleDecompression(r)
 	if err != nil {
-		http.Error(w, "Failed to decompress request body: "+err.Error(), http.StatusBadRequest)
+		renderBodyReadError(w, r, err)
 		return
 	}
 
 	orderNumber := string(body)
 	if len(orderNumber) == 0 {
-		http.Error(w, "Empty order number", http.StatusUnprocessableEntity)
+		render.Write(w, r, http.StatusUnprocessableEntity, "empty_order_number", "Unprocessable Entity", "Empty order number")
 		return
 	}
 
 	// Validate using Luhn algorithm
 	if !isValidLuhn(orderNumber) {
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity)
+		render.Write(w, r, http.StatusUnprocessableEntity, "invalid_luhn", "Unprocessable Entity", "Invalid order number format")
 		return
 	}
 
@@ -90,7 +260,7 @@ func SendOrderHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, ok := claims["user_id"].(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
 		return
 	}
 
@@ -105,7 +275,7 @@ func SendOrderHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 		switch {
 		case errors.Is(err, apperrors.ErrUserNotFound):
 			logger.Errorw("User not found", "username", username, "error", err)
-			http.Error(w, "User not found", http.StatusInternalServerError)
+			render.Write(w, r, http.StatusInternalServerError, "user_not_found", "Internal Server Error", "User not found")
 		case errors.Is(err, apperrors.ErrOrderAlreadyExists):
 			logger.Warnw("Order already exists", "username", username, "order_number", orderNumber)
 			w.WriteHeader(http.StatusOK)
@@ -113,18 +283,15 @@ func SendOrderHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 			return
 		case errors.Is(err, apperrors.ErrOrderOwnedByAnotherUser):
 			logger.Warnw("Order already exists for another user", "username", username, "order_number", orderNumber)
-			http.Error(w, "Order already exists", http.StatusConflict)
+			render.Error(w, r, err)
 			return
 		default:
 			logger.Errorw("Failed to add order", "username", username, "order_number", orderNumber, "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			render.Error(w, r, err)
 		}
 		return
 	}
 
-	// Start polling the external accrual system for order status
-	lss.PollOrderStatus(ctx, orderNumber, config.AccrualAddress)
-
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("Order accepted for processing"))
 }
@@ -133,21 +300,21 @@ func SignUpHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 	// Handle decompression
 	body, err := HandleDecompression(r)
 	if err != nil {
-		http.Error(w, "Failed to decompress request body: "+err.Error(), http.StatusBadRequest)
+		renderBodyReadError(w, r, err)
 		return
 	}
 
 	var user model.User
 	if err := json.Unmarshal(body, &user); err != nil {
 		logger.Errorw("Failed to decode user registration request", "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "invalid_request_body", "Bad Request", "Invalid request body")
 		return
 	}
 
 	// Validate input
 	if user.Username == "" || user.Password == "" {
 		logger.Errorw("Invalid registration attempt - missing credentials", "username", user.Username != "", "password", user.Password != "")
-		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "missing_credentials", "Bad Request", "Username and password are required")
 		return
 	}
 
@@ -155,45 +322,30 @@ func SignUpHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 
 	// Register the user - SetUser now handles existence checking internally
 	if err := lss.SetUser(ctx, user); err != nil {
-		// Handle specific errors with appropriate HTTP status codes
+		// Log with the right severity per case, then render the problem document.
 		switch {
 		case errors.Is(err, apperrors.ErrUserAlreadyExists):
 			logger.Warnw("Registration attempt for existing user", "username", user.Username)
-			http.Error(w, "User already exists", http.StatusConflict)
 		case errors.Is(err, apperrors.ErrInvalidRequest):
 			logger.Warnw("Invalid registration request", "username", user.Username)
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
+		case errors.Is(err, apperrors.ErrInvalidUsername):
+			logger.Warnw("Registration attempt with invalid username format", "username", user.Username)
 		case errors.Is(err, apperrors.ErrPasswordHashing):
 			logger.Errorw("Password hashing failed during registration", "username", user.Username, "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		default:
 			logger.Errorw("Failed to register user", "username", user.Username, "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
+		render.Error(w, r, err)
 		return
 	}
 
-	// Generate JWT token
-	_, tokenString, err := tokenAuth.Encode(map[string]interface{}{"user_id": user.Username})
+	tokenString, err := issueAuthTokens(r, w, lss, tokenAuth, user.Username)
 	if err != nil {
-		logger.Errorw("Failed to generate JWT token", "username", user.Username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Errorw("Failed to issue auth tokens", "username", user.Username, "error", err)
+		render.Error(w, r, err)
 		return
 	}
 
-	// Set Authorization header with Bearer token
-	w.Header().Set("Authorization", "Bearer "+tokenString)
-
-	// Also set the token as a cookie for additional compatibility
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-	})
-
 	// Return successful response with token
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -203,23 +355,59 @@ func SignUpHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 	}
 }
 
+// usernameValidation is the /api/user/validate response body: Valid is true
+// only when Error is empty, so a frontend can check either field.
+type usernameValidation struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error"`
+}
+
+// ValidateUsernameHandler lets a frontend check username availability
+// before a full registration attempt, using the same ValidateUsername rules
+// SignUpHandler enforces so the two can never disagree.
+func ValidateUsernameHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService) {
+	username := r.URL.Query().Get("username")
+
+	var resp usernameValidation
+	switch {
+	case service.ValidateUsername(username) != nil:
+		resp.Error = "invalid_username_format"
+	default:
+		exists, err := lss.UserExists(r.Context(), username)
+		if err != nil {
+			logger.Errorw("Failed to check username availability", "username", username, "error", err)
+			render.Error(w, r, err)
+			return
+		}
+		if exists {
+			resp.Error = "duplicate_username"
+		} else {
+			resp.Valid = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func SignInHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, tokenAuth *jwtauth.JWTAuth) {
 	// Handle decompression
 	body, err := HandleDecompression(r)
 	if err != nil {
-		http.Error(w, "Failed to decompress request body: "+err.Error(), http.StatusBadRequest)
+		renderBodyReadError(w, r, err)
 		return
 	}
 
 	var user model.User
 	if err := json.Unmarshal(body, &user); err != nil {
 		logger.Errorw("Failed to decode user login request", "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "invalid_request_body", "Bad Request", "Invalid request body")
 		return
 	}
 
 	if user.Username == "" || user.Password == "" {
-		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "missing_credentials", "Bad Request", "Username and password are required")
 		return
 	}
 
@@ -230,37 +418,23 @@ func SignInHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 	if err != nil {
 		// Check for specific authentication errors
 		if errors.Is(err, apperrors.ErrUserNotFound) || errors.Is(err, apperrors.ErrInvalidPassword) {
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			render.Write(w, r, http.StatusUnauthorized, "invalid_credentials", "Unauthorized", "Invalid username or password")
 			return
 		}
 
 		// Handle other errors
 		logger.Errorw("Failed to authenticate user", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		render.Error(w, r, err)
 		return
 	}
 
-	// Generate JWT token
-	_, tokenString, err := tokenAuth.Encode(map[string]interface{}{"user_id": user.Username})
+	tokenString, err := issueAuthTokens(r, w, lss, tokenAuth, user.Username)
 	if err != nil {
-		logger.Errorw("Failed to generate JWT token", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Errorw("Failed to issue auth tokens", "username", user.Username, "error", err)
+		render.Error(w, r, err)
 		return
 	}
 
-	// Set Authorization header with Bearer token
-	w.Header().Set("Authorization", "Bearer "+tokenString)
-
-	// Also set the token as a cookie for additional compatibility
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-	})
-
 	// Return the token
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -271,7 +445,7 @@ func GetOrdersHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, ok := claims["user_id"].(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
 		return
 	}
 
@@ -279,7 +453,7 @@ func GetOrdersHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 	orders, err := lss.GetOrders(ctx, username)
 	if err != nil {
 		logger.Errorw("Failed to get orders", "username", username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		render.Error(w, r, err)
 		return
 	}
 
@@ -294,7 +468,6 @@ func GetOrdersHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugare
 
 	if err := json.NewEncoder(w).Encode(orders); err != nil {
 		logger.Errorw("Failed to encode orders response", "username", username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
@@ -303,7 +476,7 @@ func GetBalanceHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugar
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, ok := claims["user_id"].(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
 		return
 	}
 
@@ -311,7 +484,7 @@ func GetBalanceHandler(w http.ResponseWriter, r *http.Request, logger *zap.Sugar
 	balance, err := lss.GetUserBalance(ctx, username)
 	if err != nil {
 		logger.Errorw("Failed to get balance", "username", username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		render.Error(w, r, err)
 		return
 	}
 
@@ -330,7 +503,7 @@ func WithdrawPointsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, ok := claims["user_id"].(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
 		return
 	}
 	ctx := r.Context()
@@ -338,27 +511,27 @@ func WithdrawPointsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 	// Handle decompression
 	body, err := HandleDecompression(r)
 	if err != nil {
-		http.Error(w, "Failed to decompress request body: "+err.Error(), http.StatusBadRequest)
+		renderBodyReadError(w, r, err)
 		return
 	}
 
 	var withdrawal model.Withdrawal
 	if err := json.Unmarshal(body, &withdrawal); err != nil {
 		logger.Errorw("Failed to decode withdrawal request", "username", username, "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "invalid_request_body", "Bad Request", "Invalid request body")
 		return
 	}
 
 	// Validate input
 	if withdrawal.Order == "" || withdrawal.Sum <= 0 {
 		logger.Warnw("Invalid withdrawal request", "username", username, "order", withdrawal.Order, "sum", withdrawal.Sum)
-		http.Error(w, "Invalid order number or sum", http.StatusBadRequest)
+		render.Write(w, r, http.StatusBadRequest, "invalid_withdrawal_request", "Bad Request", "Invalid order number or sum")
 		return
 	}
 
 	if !isValidLuhn(withdrawal.Order) {
 		logger.Warnw("Invalid order number format", "username", username, "order", withdrawal.Order)
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity) // 422
+		render.Write(w, r, http.StatusUnprocessableEntity, "invalid_luhn", "Unprocessable Entity", "Invalid order number format")
 		return
 	}
 
@@ -371,21 +544,21 @@ func WithdrawPointsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 
 	logger.Infow("Processing withdrawal", "username", username, "order", withdrawal.Order, "sum", withdrawal.Sum)
 
-	// Process withdrawal through service
-	err = lss.SpendPoints(ctx, orderWithdrawal)
+	// Process withdrawal through service. The order number is a natural,
+	// client-supplied idempotency key, so a retried request after a timeout
+	// can't double-debit the same withdrawal.
+	err = lss.SpendPointsIdempotent(ctx, withdrawal.Order, orderWithdrawal)
 	if err != nil {
-		// Handle specific errors with appropriate HTTP status codes
+		// Log with the right severity per case, then render the problem document.
 		switch {
 		case errors.Is(err, apperrors.ErrInsufficientFunds):
 			logger.Warnw("Insufficient funds for withdrawal", "username", username, "order", withdrawal.Order, "sum", withdrawal.Sum)
-			http.Error(w, "Insufficient funds", http.StatusPaymentRequired) // 402
 		case errors.Is(err, apperrors.ErrBalanceNotFound):
 			logger.Errorw("User balance not found", "username", username, "error", err)
-			http.Error(w, "User balance not found", http.StatusInternalServerError)
 		default:
 			logger.Errorw("Failed to process withdrawal", "username", username, "order", withdrawal.Order, "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
+		render.Error(w, r, err)
 		return
 	}
 
@@ -397,7 +570,7 @@ func GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, ok := claims["user_id"].(string)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
 		return
 	}
 
@@ -405,7 +578,7 @@ func GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 	withdrawals, err := lss.GetWithdrawals(ctx, username)
 	if err != nil {
 		logger.Errorw("Failed to get withdrawals", "username", username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		render.Error(w, r, err)
 		return
 	}
 
@@ -420,7 +593,124 @@ func GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request, logger *zap.S
 
 	if err := json.NewEncoder(w).Encode(withdrawals); err != nil {
 		logger.Errorw("Failed to encode withdrawals response", "username", username, "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// TokenRefreshHandler redeems the refresh token cookie for a new access
+// token, rotating the refresh token in the process. It's a public route -
+// the access token may well have already expired by the time a client needs
+// to refresh it, so it can't require a valid JWT to reach.
+func TokenRefreshHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, tokenAuth *jwtauth.JWTAuth) {
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err != nil {
+		render.Write(w, r, http.StatusUnauthorized, "refresh_token_invalid", "Unauthorized", "Invalid refresh token")
+		return
+	}
+
+	jti := uuid.NewString()
+	username, refreshToken, err := lss.RotateRefreshSession(r.Context(), cookie.Value, jti, r.UserAgent(), requestIP(r))
+	if err != nil {
+		logger.Warnw("Refresh token rotation failed", "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	_, accessToken, err := tokenAuth.Encode(map[string]interface{}{
+		"user_id": username,
+		"jti":     jti,
+		"exp":     time.Now().Add(service.AccessTokenTTL),
+	})
+	if err != nil {
+		logger.Errorw("Failed to generate JWT token", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	setAuthCookies(w, accessToken, refreshToken)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(accessToken)
+}
+
+// LogoutHandler revokes the current session: the refresh token cookie (if
+// any) is revoked so it can't be redeemed again, and the access token's jti
+// is denylisted so it stops being accepted even though it hasn't naturally
+// expired yet.
+func LogoutHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	ctx := r.Context()
+
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		expiresAt, _ := claims["exp"].(time.Time)
+		if expiresAt.IsZero() {
+			expiresAt = time.Now().Add(service.AccessTokenTTL)
+		}
+		if err := lss.RevokeAccessJTI(ctx, jti, expiresAt); err != nil {
+			logger.Errorw("Failed to revoke access token", "jti", jti, "error", err)
+			render.Error(w, r, err)
+			return
+		}
+	}
+
+	if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+		if err := lss.RevokeRefreshSessionByToken(ctx, cookie.Value); err != nil {
+			logger.Errorw("Failed to revoke refresh token", "error", err)
+			render.Error(w, r, err)
+			return
+		}
+	}
+
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+// ListSessionsHandler returns the caller's active refresh sessions, so a
+// user can audit which devices/browsers are currently logged in.
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, ok := claims["user_id"].(string)
+	if !ok {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+
+	sessions, err := lss.ListActiveRefreshSessions(r.Context(), username)
+	if err != nil {
+		logger.Errorw("Failed to list sessions", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		logger.Errorw("Failed to encode sessions response", "username", username, "error", err)
+	}
+}
+
+// RevokeSessionHandler revokes a single one of the caller's refresh
+// sessions, identified by the access-token jti it was issued alongside, for
+// the "revoke this one device" action in a sessions-audit view.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, ok := claims["user_id"].(string)
+	if !ok {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+
+	jti := chi.URLParam(r, "jti")
+	if err := lss.RevokeRefreshSessionByJTI(r.Context(), username, jti); err != nil {
+		if errors.Is(err, apperrors.ErrRefreshTokenNotFound) {
+			render.Write(w, r, http.StatusNotFound, "session_not_found", "Not Found", "No active session with that ID")
+			return
+		}
+		logger.Warnw("Failed to revoke session", "username", username, "jti", jti, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
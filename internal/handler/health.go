@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Schera-ole/loyalty_system/internal/health"
+)
+
+// HealthzHandler reports the cached storage health probe: 200 when it last
+// succeeded, 503 otherwise.
+func HealthzHandler(checker *health.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealthStatus(w, checker.Healthz())
+	}
+}
+
+// ReadyzHandler additionally gates on the accrual system being reachable
+// right now, so orchestrators can hold traffic back until it's up.
+func ReadyzHandler(checker *health.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealthStatus(w, checker.Readyz(r.Context()))
+	}
+}
+
+func writeHealthStatus(w http.ResponseWriter, status health.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Healthy() {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -3,13 +3,23 @@ package handler
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/render"
 )
 
+// maxDecompressedBodySize bounds how much DecompressBody will inflate a
+// gzipped request into, regardless of how small the body was on the wire -
+// MaxBytesMiddleware caps the compressed size, but a gzip bomb can still
+// expand a tiny body into gigabytes without this second cap.
+const maxDecompressedBodySize = 1 << 20 // 1 MiB
+
 func DecompressBody(body []byte) ([]byte, error) {
 	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
 	if err != nil {
@@ -17,16 +27,23 @@ func DecompressBody(body []byte) ([]byte, error) {
 	}
 	defer gzipReader.Close()
 
-	decompressedData, err := io.ReadAll(gzipReader)
+	decompressedData, err := io.ReadAll(io.LimitReader(gzipReader, maxDecompressedBodySize+1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decompress data: %w", err)
 	}
+	if len(decompressedData) > maxDecompressedBodySize {
+		return nil, fmt.Errorf("%w: decompressed body exceeds %d bytes", apperrors.ErrPayloadTooLarge, maxDecompressedBodySize)
+	}
 	return decompressedData, nil
 }
 
 func ReadRequestBody(r *http.Request) ([]byte, error) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, fmt.Errorf("%w: %s", apperrors.ErrPayloadTooLarge, err)
+		}
 		return nil, fmt.Errorf("failed to read request body: %w", err)
 	}
 	r.Body.Close()
@@ -54,6 +71,18 @@ func HandleDecompression(r *http.Request) ([]byte, error) {
 	return processData, nil
 }
 
+// renderBodyReadError maps a HandleDecompression failure to a problem
+// response: 413 when it tripped a size cap (the route's MaxBytesMiddleware
+// limit or the post-decompression cap), 400 for any other decompression
+// failure.
+func renderBodyReadError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, apperrors.ErrPayloadTooLarge) {
+		render.Error(w, r, err)
+		return
+	}
+	render.Write(w, r, http.StatusBadRequest, "decompression_failed", "Bad Request", "Failed to decompress request body: "+err.Error())
+}
+
 func isIntegerAtoi(s string) bool {
 	_, err := strconv.Atoi(s)
 	return err == nil
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Schera-ole/loyalty_system/internal/render"
+	"github.com/Schera-ole/loyalty_system/internal/service"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+type clientCertContextKey struct{}
+
+// ClientIdentityFromContext returns the CN of the client certificate that
+// authenticated the request, if the request came in over mTLS rather than
+// a JWT.
+func ClientIdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(clientCertContextKey{}).(string)
+	return identity, ok
+}
+
+// clientCertIdentity extracts the verified client certificate's CN from the
+// request's TLS connection state, if one was presented.
+func clientCertIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName, true
+}
+
+// RequireJWTOrClientCert authenticates a request either via a verified mTLS
+// client certificate or, falling back, the usual JWT bearer token - and for
+// the JWT path, rejects a token whose jti has been denylisted (logout, a
+// detected refresh-token replay) even though it hasn't naturally expired
+// yet. This lets bouncer-style service callers authenticate with a
+// certificate instead of a password while leaving the JWT path for normal
+// users untouched.
+func RequireJWTOrClientCert(tokenAuth *jwtauth.JWTAuth, lss *service.LoyaltySystemService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		jwtProtected := jwtauth.Verifier(tokenAuth)(jwtauth.Authenticator(tokenAuth)(requireUnrevokedJTI(lss, next)))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identity, ok := clientCertIdentity(r); ok {
+				ctx := context.WithValue(r.Context(), clientCertContextKey{}, identity)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			jwtProtected.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireUnrevokedJTI rejects an otherwise-valid JWT whose jti claim has
+// been denylisted by LoyaltySystemService.RevokeAccessJTI.
+func requireUnrevokedJTI(lss *service.LoyaltySystemService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		jti, _ := claims["jti"].(string)
+		if jti != "" {
+			revoked, err := lss.IsAccessJTIRevoked(r.Context(), jti)
+			if err != nil {
+				render.Error(w, r, err)
+				return
+			}
+			if revoked {
+				render.Write(w, r, http.StatusUnauthorized, "token_revoked", "Unauthorized", "Access token has been revoked")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/auth"
+	"github.com/Schera-ole/loyalty_system/internal/render"
+	"github.com/Schera-ole/loyalty_system/internal/service"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth/v5"
+	"go.uber.org/zap"
+)
+
+const oauthStateCookie = "oauth_state"
+
+// oauthState is what OAuthLoginHandler/OAuthLinkHandler stash in the state
+// cookie and OAuthCallbackHandler reads back: a random value compared
+// against the provider's callback "state" query parameter for CSRF
+// protection, plus an optional URL to send the user back to once login
+// completes. LinkUsername is set only by OAuthLinkHandler, and tells the
+// callback to attach the identity to that already-authenticated account
+// instead of resolving or provisioning one by email.
+type oauthState struct {
+	State        string `json:"state"`
+	Next         string `json:"next,omitempty"`
+	LinkUsername string `json:"link_username,omitempty"`
+}
+
+// OAuthLoginHandler starts the authorization-code flow for the {provider}
+// path param: it stashes a random state (and optional ?next= redirect) in a
+// short-lived cookie and 302s to the provider's consent screen.
+func OAuthLoginHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, providers map[string]*auth.OAuthProvider) {
+	startOAuthFlow(w, r, logger, providers, "")
+}
+
+// OAuthLinkHandler starts the authorization-code flow to link a provider to
+// the caller's already-authenticated account, so a password or passkey
+// account can add a social login alongside its existing credential instead
+// of provisioning a brand-new federated-only account for it.
+func OAuthLinkHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, providers map[string]*auth.OAuthProvider) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, ok := claims["user_id"].(string)
+	if !ok {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+	startOAuthFlow(w, r, logger, providers, username)
+}
+
+func startOAuthFlow(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, providers map[string]*auth.OAuthProvider, linkUsername string) {
+	provider, ok := providers[chi.URLParam(r, "provider")]
+	if !ok {
+		render.Write(w, r, http.StatusNotFound, "unknown_oauth_provider", "Not Found", "Unknown OAuth provider")
+		return
+	}
+
+	state, err := randomState()
+	if err != nil {
+		logger.Errorw("Failed to generate oauth state", "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	next := r.URL.Query().Get("next")
+	if !isSafeRedirectPath(next) {
+		next = ""
+	}
+
+	data, err := json.Marshal(oauthState{State: state, Next: next, LinkUsername: linkUsername})
+	if err != nil {
+		logger.Errorw("Failed to encode oauth state", "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusFound)
+}
+
+// OAuthCallbackHandler completes the flow: it validates the callback's state
+// against the cookie, exchanges the code, fetches the federated identity,
+// links or provisions the account, and issues the same JWT the password and
+// WebAuthn login handlers do.
+func OAuthCallbackHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, providers map[string]*auth.OAuthProvider, tokenAuth *jwtauth.JWTAuth) {
+	providerName := chi.URLParam(r, "provider")
+	provider, ok := providers[providerName]
+	if !ok {
+		render.Write(w, r, http.StatusNotFound, "unknown_oauth_provider", "Not Found", "Unknown OAuth provider")
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		render.Write(w, r, http.StatusBadRequest, "oauth_state_missing", "Bad Request", "Missing or expired oauth state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+
+	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	var stashed oauthState
+	if err == nil {
+		err = json.Unmarshal(raw, &stashed)
+	}
+	if err != nil {
+		render.Write(w, r, http.StatusBadRequest, "oauth_state_invalid", "Bad Request", "Invalid oauth state")
+		return
+	}
+
+	if queryState := r.URL.Query().Get("state"); queryState == "" || queryState != stashed.State {
+		logger.Warnw("OAuth state mismatch", "provider", providerName)
+		render.Write(w, r, http.StatusBadRequest, "oauth_state_invalid", "Bad Request", "Invalid oauth state")
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		render.Write(w, r, http.StatusBadRequest, "oauth_code_missing", "Bad Request", "Missing authorization code")
+		return
+	}
+
+	ctx := r.Context()
+	token, err := provider.Exchange(ctx, code)
+	if err != nil {
+		logger.Errorw("Failed to exchange oauth code", "provider", providerName, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	subject, email, err := provider.FetchIdentity(ctx, token)
+	if err != nil || subject == "" {
+		logger.Errorw("Failed to fetch oauth identity", "provider", providerName, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	username := stashed.LinkUsername
+	if username != "" {
+		if err := lss.LinkFederatedIdentity(ctx, username, providerName, subject, email); err != nil {
+			logger.Errorw("Failed to link federated identity", "provider", providerName, "username", username, "error", err)
+			render.Error(w, r, err)
+			return
+		}
+	} else {
+		username, err = lss.LinkOrCreateFederatedUser(ctx, providerName, subject, email)
+		if err != nil {
+			logger.Errorw("Failed to link federated user", "provider", providerName, "error", err)
+			render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+			return
+		}
+	}
+
+	tokenString, err := issueAuthTokens(r, w, lss, tokenAuth, username)
+	if err != nil {
+		logger.Errorw("Failed to issue auth tokens", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	if isSafeRedirectPath(stashed.Next) {
+		http.Redirect(w, r, stashed.Next, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokenString)
+}
+
+func randomState() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// isSafeRedirectPath reports whether next is safe to redirect a
+// post-login user to: a path relative to this host, not a
+// protocol-relative or absolute URL that could send them to an
+// attacker-controlled site.
+func isSafeRedirectPath(next string) bool {
+	if next == "" || next[0] != '/' {
+		return false
+	}
+	return len(next) < 2 || next[1] != '/'
+}
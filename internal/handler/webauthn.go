@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/Schera-ole/loyalty_system/internal/auth"
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/Schera-ole/loyalty_system/internal/render"
+	"github.com/Schera-ole/loyalty_system/internal/service"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const webAuthnSessionCookie = "webauthn_session"
+
+// webAuthnSession is what RegisterBegin/LoginBegin persist via
+// SaveWebAuthnSession, read back by the matching finish step so it knows
+// which user the in-flight ceremony belongs to.
+type webAuthnSession struct {
+	Username string
+	Data     webauthn.SessionData
+}
+
+func WebAuthnRegisterBeginHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, rp *webauthn.WebAuthn) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, ok := claims["user_id"].(string)
+	if !ok {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+	ctx := r.Context()
+
+	credentials, err := lss.GetCredentialsByUser(ctx, username)
+	if err != nil {
+		logger.Errorw("Failed to load webauthn credentials", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	user := auth.WebAuthnUser{Username: username, Credentials: credentials}
+	creation, sessionData, err := rp.BeginRegistration(user)
+	if err != nil {
+		logger.Errorw("Failed to begin webauthn registration", "username", username, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	if err := saveWebAuthnSession(ctx, w, lss, username, sessionData); err != nil {
+		logger.Errorw("Failed to save webauthn session", "username", username, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(creation)
+}
+
+func WebAuthnRegisterFinishHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, rp *webauthn.WebAuthn) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, ok := claims["user_id"].(string)
+	if !ok {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+	ctx := r.Context()
+
+	body, err := HandleDecompression(r)
+	if err != nil {
+		renderBodyReadError(w, r, err)
+		return
+	}
+
+	session, err := loadWebAuthnSession(ctx, r, lss)
+	if err != nil {
+		logger.Warnw("No webauthn session for registration finish", "username", username, "error", err)
+		render.Write(w, r, http.StatusBadRequest, "webauthn_session_not_found", "Bad Request", "Registration session expired or not found")
+		return
+	}
+	if session.Username != username {
+		render.Write(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized", "Unauthorized")
+		return
+	}
+
+	credentials, err := lss.GetCredentialsByUser(ctx, username)
+	if err != nil {
+		logger.Errorw("Failed to load webauthn credentials", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+	user := auth.WebAuthnUser{Username: username, Credentials: credentials}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	credential, err := rp.FinishRegistration(user, session.Data, r)
+	if err != nil {
+		logger.Warnw("Failed to finish webauthn registration", "username", username, "error", err)
+		render.Write(w, r, http.StatusBadRequest, "invalid_registration_response", "Bad Request", "Invalid registration response")
+		return
+	}
+
+	cred := auth.CredentialFromWebAuthn(credential)
+	cred.AttestationJSON = body
+	if err := lss.RegisterCredential(ctx, username, cred); err != nil {
+		logger.Errorw("Failed to save webauthn credential", "username", username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	deleteWebAuthnSession(ctx, w, r, lss)
+	w.WriteHeader(http.StatusOK)
+}
+
+func WebAuthnLoginBeginHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, rp *webauthn.WebAuthn) {
+	body, err := HandleDecompression(r)
+	if err != nil {
+		renderBodyReadError(w, r, err)
+		return
+	}
+
+	var user model.User
+	if err := json.Unmarshal(body, &user); err != nil || user.Username == "" {
+		render.Write(w, r, http.StatusBadRequest, "missing_username", "Bad Request", "Username is required")
+		return
+	}
+
+	ctx := r.Context()
+	credentials, err := lss.GetCredentialsByUser(ctx, user.Username)
+	if err != nil {
+		logger.Errorw("Failed to load webauthn credentials", "username", user.Username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+	if len(credentials) == 0 {
+		render.Write(w, r, http.StatusUnauthorized, "no_credentials_registered", "Unauthorized", "No credentials registered for user")
+		return
+	}
+
+	webAuthnUser := auth.WebAuthnUser{Username: user.Username, Credentials: credentials}
+	assertion, sessionData, err := rp.BeginLogin(webAuthnUser)
+	if err != nil {
+		logger.Errorw("Failed to begin webauthn login", "username", user.Username, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	if err := saveWebAuthnSession(ctx, w, lss, user.Username, sessionData); err != nil {
+		logger.Errorw("Failed to save webauthn session", "username", user.Username, "error", err)
+		render.Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(assertion)
+}
+
+func WebAuthnLoginFinishHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, lss *service.LoyaltySystemService, rp *webauthn.WebAuthn, tokenAuth *jwtauth.JWTAuth) {
+	body, err := HandleDecompression(r)
+	if err != nil {
+		renderBodyReadError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	session, err := loadWebAuthnSession(ctx, r, lss)
+	if err != nil {
+		logger.Warnw("No webauthn session for login finish", "error", err)
+		render.Write(w, r, http.StatusBadRequest, "webauthn_session_not_found", "Bad Request", "Login session expired or not found")
+		return
+	}
+
+	credentials, err := lss.GetCredentialsByUser(ctx, session.Username)
+	if err != nil {
+		logger.Errorw("Failed to load webauthn credentials", "username", session.Username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+	user := auth.WebAuthnUser{Username: session.Username, Credentials: credentials}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	credential, err := rp.FinishLogin(user, session.Data, r)
+	if err != nil {
+		logger.Warnw("Failed to finish webauthn login", "username", session.Username, "error", err)
+		render.Write(w, r, http.StatusUnauthorized, "invalid_login_response", "Unauthorized", "Invalid login response")
+		return
+	}
+
+	if err := lss.UpdateCredentialCounter(ctx, credential.ID, credential.Authenticator.SignCount); err != nil {
+		logger.Errorw("Failed to update credential counter", "username", session.Username, "error", err)
+	}
+	deleteWebAuthnSession(ctx, w, r, lss)
+
+	tokenString, err := issueAuthTokens(r, w, lss, tokenAuth, session.Username)
+	if err != nil {
+		logger.Errorw("Failed to issue auth tokens", "username", session.Username, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokenString)
+}
+
+func saveWebAuthnSession(ctx context.Context, w http.ResponseWriter, lss *service.LoyaltySystemService, username string, sessionData *webauthn.SessionData) error {
+	data, err := json.Marshal(webAuthnSession{Username: username, Data: *sessionData})
+	if err != nil {
+		return err
+	}
+
+	sessionID := uuid.NewString()
+	if err := lss.SaveWebAuthnSession(ctx, sessionID, data); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnSessionCookie,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func loadWebAuthnSession(ctx context.Context, r *http.Request, lss *service.LoyaltySystemService) (webAuthnSession, error) {
+	var session webAuthnSession
+
+	cookie, err := r.Cookie(webAuthnSessionCookie)
+	if err != nil {
+		return session, apperrors.ErrWebAuthnSessionNotFound
+	}
+
+	data, err := lss.GetWebAuthnSession(ctx, cookie.Value)
+	if err != nil {
+		return session, err
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+func deleteWebAuthnSession(ctx context.Context, w http.ResponseWriter, r *http.Request, lss *service.LoyaltySystemService) {
+	if cookie, err := r.Cookie(webAuthnSessionCookie); err == nil {
+		lss.DeleteWebAuthnSession(ctx, cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnSessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
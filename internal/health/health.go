@@ -0,0 +1,173 @@
+// Package health periodically probes the storage backend with a real
+// round-trip and caches the result behind a RWMutex, so the /healthz and
+// /readyz handlers answer from memory instead of hitting the database on
+// every request.
+package health
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/repository"
+	"go.uber.org/zap"
+)
+
+// accrualProbeTimeout bounds the live HEAD request Readyz makes against the
+// accrual system; it's independent of the background storage probe's
+// interval since readiness has to reflect the dependency's state right now.
+const accrualProbeTimeout = 2 * time.Second
+
+// Check is the result of probing a single dependency.
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Status is the cached health snapshot served by /healthz, and the basis
+// Readyz extends with a live accrual check for /readyz.
+type Status struct {
+	Status        string    `json:"status"`
+	LastCheckAt   time.Time `json:"last_check_at"`
+	LastLatencyMs int64     `json:"last_latency_ms"`
+	Checks        []Check   `json:"checks"`
+}
+
+// Healthy reports whether every check in the snapshot passed.
+func (s Status) Healthy() bool {
+	return s.Status == "healthy"
+}
+
+// Checker runs a background goroutine that exercises repo with a real
+// round trip (ProbeWrite) every interval and caches the result. ProbeAccrual
+// additionally gates Readyz on the accrual system at accrualAddress being
+// reachable, for deployments that want traffic held back until it's up.
+type Checker struct {
+	repo           repository.HealthChecker
+	interval       time.Duration
+	accrualAddress string
+	probeAccrual   bool
+	httpClient     *http.Client
+	logger         *zap.SugaredLogger
+
+	mu     sync.RWMutex
+	status Status
+}
+
+// NewChecker builds a Checker. The cached status starts unhealthy (no
+// checks have run yet) until the first probe completes, either from Run's
+// initial tick or an explicit call to Probe.
+func NewChecker(repo repository.HealthChecker, interval time.Duration, accrualAddress string, probeAccrual bool, logger *zap.SugaredLogger) *Checker {
+	return &Checker{
+		repo:           repo,
+		interval:       interval,
+		accrualAddress: accrualAddress,
+		probeAccrual:   probeAccrual,
+		httpClient:     &http.Client{Timeout: accrualProbeTimeout},
+		logger:         logger,
+		status:         Status{Status: "unhealthy", Checks: []Check{{Name: "storage", OK: false, Error: "no check has run yet"}}},
+	}
+}
+
+// Run probes the storage backend immediately, then every interval, and
+// blocks until ctx is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	c.Probe(ctx)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Probe(ctx)
+		}
+	}
+}
+
+// Probe exercises the storage backend with a real write-then-delete round
+// trip and caches the result. A plain Ping would miss a read-only or
+// otherwise degraded database that still answers connection checks.
+func (c *Checker) Probe(ctx context.Context) {
+	start := time.Now()
+	err := c.repo.ProbeWrite(ctx)
+	latency := time.Since(start)
+
+	check := Check{Name: "storage", OK: err == nil}
+	status := "healthy"
+	if err != nil {
+		check.Error = err.Error()
+		status = "unhealthy"
+		if c.logger != nil {
+			c.logger.Errorw("Storage health probe failed", "error", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.status = Status{
+		Status:        status,
+		LastCheckAt:   start,
+		LastLatencyMs: latency.Milliseconds(),
+		Checks:        []Check{check},
+	}
+	c.mu.Unlock()
+}
+
+// Healthz returns the cached storage probe result.
+func (c *Checker) Healthz() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// Readyz returns the cached storage result plus, when enabled, a live HEAD
+// check of the accrual system - readiness has to reflect whether that
+// dependency is up right now, not its state at the last 15s tick.
+func (c *Checker) Readyz(ctx context.Context) Status {
+	status := c.Healthz()
+	if !c.probeAccrual {
+		return status
+	}
+
+	checks := make([]Check, len(status.Checks), len(status.Checks)+1)
+	copy(checks, status.Checks)
+
+	accrualCheck := Check{Name: "accrual", OK: true}
+	if err := c.probeAccrualReachable(ctx); err != nil {
+		accrualCheck.OK = false
+		accrualCheck.Error = err.Error()
+		status.Status = "unhealthy"
+	}
+	status.Checks = append(checks, accrualCheck)
+	return status
+}
+
+func (c *Checker) probeAccrualReachable(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, accrualProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, withScheme(c.accrualAddress), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// withScheme defaults address to http:// when it names no scheme, so the
+// probe still works against the bare host:port form AccrualAddress is
+// documented and configured with by default.
+func withScheme(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	return "http://" + address
+}
@@ -0,0 +1,197 @@
+// Package jobs implements a persistent, restart-safe worker pool that drains
+// the accrual_poll_jobs table instead of polling orders from in-process
+// goroutines.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/accrual"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/Schera-ole/loyalty_system/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Worker drains due accrual_poll_jobs rows with a bounded pool of goroutines.
+// Any order in a non-final state has exactly one live row in the table; each
+// tick a worker claims up to batchSize rows, makes one accrual.Client call
+// per row, and applies every row that reached a final status in a single
+// CompletePollJobsBatch call instead of one transaction per order.
+type Worker struct {
+	repo            repository.OrderStore
+	accrualClient   *accrual.Client
+	backoffBase     time.Duration
+	maxAttempts     int
+	circuitCooldown time.Duration
+	batchSize       int
+	logger          *zap.SugaredLogger
+}
+
+func NewWorker(repo repository.OrderStore, accrualClient *accrual.Client, backoffBase time.Duration, maxAttempts int, circuitCooldown time.Duration, batchSize int, logger *zap.SugaredLogger) *Worker {
+	return &Worker{
+		repo:            repo,
+		accrualClient:   accrualClient,
+		backoffBase:     backoffBase,
+		maxAttempts:     maxAttempts,
+		circuitCooldown: circuitCooldown,
+		batchSize:       batchSize,
+		logger:          logger,
+	}
+}
+
+// Run starts poolSize goroutines draining the queue and blocks until ctx is
+// cancelled.
+func (w *Worker) Run(ctx context.Context, poolSize int) {
+	done := make(chan struct{})
+	for i := 0; i < poolSize; i++ {
+		go func() {
+			w.loop(ctx)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < poolSize; i++ {
+		<-done
+	}
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.claimAndProcessBatch(ctx)
+		}
+	}
+}
+
+func (w *Worker) claimAndProcessBatch(ctx context.Context) {
+	due, err := w.repo.ClaimDuePollJobs(ctx, w.batchSize)
+	if err != nil {
+		if w.logger != nil {
+			w.logger.Errorw("Error claiming poll jobs", "error", err)
+		}
+		return
+	}
+
+	// Poll every claimed job concurrently: sequentially would serialize up
+	// to batchSize accrual.Client round trips behind a single tick.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	final := make([]model.AccrualResponse, 0, len(due))
+	for _, job := range due {
+		wg.Add(1)
+		go func(job model.PollJob) {
+			defer wg.Done()
+			if result, ok := w.poll(ctx, job); ok {
+				mu.Lock()
+				final = append(final, result)
+				mu.Unlock()
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	if len(final) == 0 {
+		return
+	}
+
+	if err := w.repo.CompletePollJobsBatch(ctx, final); err != nil {
+		if w.logger != nil {
+			w.logger.Errorw("Error completing poll job batch", "error", err, "count", len(final))
+		}
+		return
+	}
+	if w.logger != nil {
+		w.logger.Infow("Poll job batch reached final status", "count", len(final))
+	}
+}
+
+// poll makes one accrual.Client call for job. A final status (PROCESSED or
+// INVALID) is returned for the caller to apply in a batch; anything else -
+// an error, a rate limit, or a non-final status - reschedules job itself.
+func (w *Worker) poll(ctx context.Context, job model.PollJob) (model.AccrualResponse, bool) {
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	accrualResponse, err := w.accrualClient.GetOrder(reqCtx, job.OrderNumber)
+	if err != nil {
+		var rateLimited *accrual.RateLimitedError
+		switch {
+		case errors.Is(err, accrual.ErrCircuitOpen):
+			if w.logger != nil {
+				w.logger.Warnw("Accrual circuit open, deferring poll job", "order", job.OrderNumber)
+			}
+			w.rescheduleAfter(ctx, job, w.circuitCooldown)
+		case errors.As(err, &rateLimited):
+			if w.logger != nil {
+				w.logger.Warnw("Rate limited by accrual system", "order", job.OrderNumber, "retryAfter", rateLimited.RetryAfter.String())
+			}
+			w.rescheduleAfter(ctx, job, rateLimited.RetryAfter)
+		case errors.Is(err, accrual.ErrOrderNotRegistered):
+			w.reschedule(ctx, job)
+		default:
+			if w.logger != nil {
+				w.logger.Errorw("Error polling accrual system", "error", err, "order", job.OrderNumber)
+			}
+			w.reschedule(ctx, job)
+		}
+		return model.AccrualResponse{}, false
+	}
+
+	if accrualResponse.Status == "PROCESSED" || accrualResponse.Status == "INVALID" {
+		return accrualResponse, true
+	}
+
+	w.reschedule(ctx, job)
+	return model.AccrualResponse{}, false
+}
+
+// process polls a single job and, if it reached a final status, completes it
+// immediately via CompletePollJob. claimAndProcessBatch doesn't use this -
+// it batches completions across a whole claimed round instead - but it's a
+// convenient synchronous single-job entry point for tests.
+func (w *Worker) process(ctx context.Context, job model.PollJob) {
+	result, ok := w.poll(ctx, job)
+	if !ok {
+		return
+	}
+	if err := w.repo.CompletePollJob(ctx, job.OrderNumber, result.Status, result.Accrual); err != nil {
+		if w.logger != nil {
+			w.logger.Errorw("Error completing poll job", "error", err, "order", job.OrderNumber)
+		}
+	}
+}
+
+func (w *Worker) reschedule(ctx context.Context, job model.PollJob) {
+	w.rescheduleAfter(ctx, job, backoff(w.backoffBase, job.Attempts+1))
+}
+
+func (w *Worker) rescheduleAfter(ctx context.Context, job model.PollJob, delay time.Duration) {
+	if job.Attempts+1 >= w.maxAttempts && w.logger != nil {
+		w.logger.Warnw("Poll job exceeded max attempts, still rescheduling", "order", job.OrderNumber, "attempts", job.Attempts+1)
+	}
+	if err := w.repo.ReschedulePollJob(ctx, job.OrderNumber, time.Now().Add(delay)); err != nil && w.logger != nil {
+		w.logger.Errorw("Error rescheduling poll job", "error", err, "order", job.OrderNumber)
+	}
+}
+
+// backoff computes an exponential delay with jitter, capped at a reasonable
+// ceiling so a long-stuck order doesn't end up polled once an hour.
+func backoff(base time.Duration, attempt int) time.Duration {
+	const maxDelay = 5 * time.Minute
+	delay := base * time.Duration(math.Pow(2, float64(attempt-1)))
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
@@ -0,0 +1,194 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/accrual"
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gopkg.in/dnaeon/go-vcr.v4/pkg/recorder"
+)
+
+// accrualBaseURL is the host recorded into every cassette under testdata/cassettes.
+const accrualBaseURL = "http://accrual.internal"
+
+// newCassetteWorker returns a Worker wired to an accrual.Client whose HTTP
+// round trips are served from (or, with VCR_RECORD=1, recorded into) the
+// named cassette. Run `VCR_RECORD=1 go test ./internal/jobs/...` against a
+// real accrual stub to refresh a cassette.
+func newCassetteWorker(t *testing.T, cassette string, repo *fakeRepo) *Worker {
+	t.Helper()
+	worker, _ := newObservedCassetteWorker(t, cassette, repo)
+	return worker
+}
+
+// newObservedCassetteWorker is like newCassetteWorker but also returns an
+// observer.ObservedLogs so a test can assert on what, if anything, the
+// worker logged while processing a job.
+func newObservedCassetteWorker(t *testing.T, cassette string, repo *fakeRepo) (*Worker, *observer.ObservedLogs) {
+	t.Helper()
+
+	mode := recorder.ModeReplayOnly
+	if os.Getenv("VCR_RECORD") == "1" {
+		mode = recorder.ModeRecordOnly
+	}
+
+	rec, err := recorder.New(filepath.Join("testdata", "cassettes", cassette), recorder.WithMode(mode))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, rec.Stop()) })
+
+	accrualClient := accrual.NewClientWithHTTPClient(accrualBaseURL, 5, 30*time.Second, &http.Client{Transport: rec})
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(core).Sugar()
+	return NewWorker(repo, accrualClient, 5*time.Second, 10, 30*time.Second, 10, logger), logs
+}
+
+func TestProcess_LifecycleReachesProcessed(t *testing.T) {
+	repo := newFakeRepo()
+	worker := newCassetteWorker(t, "order_lifecycle", repo)
+	job := model.PollJob{OrderNumber: "12345678903"}
+	ctx := context.Background()
+
+	// REGISTERED and PROCESSING both reschedule; only PROCESSED completes.
+	worker.process(ctx, job)
+	assert.Equal(t, 0, repo.completedCalls)
+	worker.process(ctx, job)
+	assert.Equal(t, 0, repo.completedCalls)
+	worker.process(ctx, job)
+	require.Equal(t, 1, repo.completedCalls)
+	assert.Equal(t, "PROCESSED", repo.lastStatus)
+	require.NotNil(t, repo.lastAccrual)
+	assert.Equal(t, 500.0, *repo.lastAccrual)
+}
+
+func TestProcess_InvalidShortCircuits(t *testing.T) {
+	repo := newFakeRepo()
+	worker := newCassetteWorker(t, "order_invalid", repo)
+
+	worker.process(context.Background(), model.PollJob{OrderNumber: "12345678903"})
+
+	require.Equal(t, 1, repo.completedCalls)
+	assert.Equal(t, "INVALID", repo.lastStatus)
+	assert.Nil(t, repo.lastAccrual)
+}
+
+func TestProcess_NotYetRegisteredReschedules(t *testing.T) {
+	repo := newFakeRepo()
+	worker, logs := newObservedCassetteWorker(t, "order_not_registered", repo)
+
+	worker.process(context.Background(), model.PollJob{OrderNumber: "12345678903"})
+
+	assert.Equal(t, 0, repo.completedCalls)
+	assert.Equal(t, 1, repo.rescheduledCalls)
+	// ErrOrderNotRegistered is an expected, silent wait-and-retry - unlike the
+	// default error branch, it must not log at error level.
+	assert.Equal(t, 0, logs.FilterLevelExact(zap.ErrorLevel).Len())
+}
+
+func TestProcess_RateLimitedNumericRetryAfter(t *testing.T) {
+	repo := newFakeRepo()
+	worker := newCassetteWorker(t, "rate_limited_numeric", repo)
+
+	before := time.Now()
+	worker.process(context.Background(), model.PollJob{OrderNumber: "12345678903"})
+
+	require.Equal(t, 1, repo.rescheduledCalls)
+	assert.WithinDuration(t, before.Add(120*time.Second), repo.lastNextAttempt, 5*time.Second)
+}
+
+func TestProcess_RateLimitedHTTPDateRetryAfter(t *testing.T) {
+	repo := newFakeRepo()
+	worker := newCassetteWorker(t, "rate_limited_http_date", repo)
+
+	worker.process(context.Background(), model.PollJob{OrderNumber: "12345678903"})
+
+	require.Equal(t, 1, repo.rescheduledCalls)
+	wantRetryAfter := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.WithinDuration(t, wantRetryAfter, repo.lastNextAttempt, 5*time.Second)
+}
+
+func TestProcess_ServerErrorThenSuccess(t *testing.T) {
+	repo := newFakeRepo()
+	worker := newCassetteWorker(t, "server_error_then_success", repo)
+	job := model.PollJob{OrderNumber: "12345678903"}
+
+	worker.process(context.Background(), job)
+	assert.Equal(t, 1, repo.rescheduledCalls)
+	assert.Equal(t, 0, repo.completedCalls)
+
+	worker.process(context.Background(), job)
+	require.Equal(t, 1, repo.completedCalls)
+	assert.Equal(t, "PROCESSED", repo.lastStatus)
+}
+
+// fakeRepo implements the subset of repository.Repository exercised by
+// Worker.process; every other method panics if the test didn't expect it.
+type fakeRepo struct {
+	completedCalls   int
+	rescheduledCalls int
+	lastStatus       string
+	lastAccrual      *float64
+	lastNextAttempt  time.Time
+}
+
+func newFakeRepo() *fakeRepo { return &fakeRepo{} }
+
+func (r *fakeRepo) CompletePollJob(_ context.Context, _ string, status string, accrualValue *float64) error {
+	r.completedCalls++
+	r.lastStatus = status
+	r.lastAccrual = accrualValue
+	return nil
+}
+
+func (r *fakeRepo) ReschedulePollJob(_ context.Context, _ string, nextAttemptAt time.Time) error {
+	r.rescheduledCalls++
+	r.lastNextAttempt = nextAttemptAt
+	return nil
+}
+
+func (r *fakeRepo) SetUser(context.Context, model.User) error { panic("not used by Worker.process") }
+func (r *fakeRepo) CheckUser(context.Context, model.User) (bool, error) {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) AddOrder(context.Context, string, string) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) UpdateOrderStatus(context.Context, string, string) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) UpdateOrderStatusAndAccrual(context.Context, string, string, *float64) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) GetOrders(context.Context, string) ([]model.Order, error) {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) GetUserBalance(context.Context, string) (model.UserBalance, error) {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) GetWithdrawals(context.Context, string) ([]model.Withdrawal, error) {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) SpendPoints(context.Context, model.OrderWithdrawal) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) PostTransaction(context.Context, ledger.Transaction) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) EnqueuePollJob(context.Context, string) error { panic("not used by Worker.process") }
+func (r *fakeRepo) ClaimDuePollJobs(context.Context, int) ([]model.PollJob, error) {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) CompletePollJobsBatch(context.Context, []model.AccrualResponse) error {
+	panic("not used by Worker.process")
+}
+func (r *fakeRepo) Ping(context.Context) error { panic("not used by Worker.process") }
+func (r *fakeRepo) Close() error               { panic("not used by Worker.process") }
@@ -0,0 +1,87 @@
+// Package ledger models loyalty point movements as double-entry bookkeeping
+// transactions instead of a scalar balance column. Every change to a user's
+// balance is a pair of postings that net to zero: a credit into
+// users/<login>/available funded either by a system/accrual/<order> source
+// or debited into users/<login>/spent.
+package ledger
+
+const (
+	KindAccrual    = "accrual"
+	KindWithdrawal = "withdrawal"
+)
+
+// Posting is a single account movement within a Transaction. A positive
+// Amount credits the account, a negative Amount debits it.
+type Posting struct {
+	Account string
+	Amount  float64
+}
+
+// Transaction is the unit of work posted to the ledger: a named set of
+// postings that must net to zero, plus the order and kind it relates to.
+type Transaction struct {
+	TxID     string
+	Order    string
+	Kind     string
+	Metadata map[string]interface{}
+	Postings []Posting
+}
+
+// AvailableAccount is the account holding a user's spendable balance.
+func AvailableAccount(username string) string {
+	return "users/" + username + "/available"
+}
+
+// SpentAccount is the account a user's withdrawals are posted against.
+func SpentAccount(username string) string {
+	return "users/" + username + "/spent"
+}
+
+// AccrualAccount is the system source account an order's accrual is funded
+// from.
+func AccrualAccount(order string) string {
+	return "system/accrual/" + order
+}
+
+// AccrualTxID derives the transaction id for an idempotent accrual credit
+// keyed by key (typically the order number, or a caller-supplied
+// idempotency key). Posting under the same key twice is rejected as a
+// duplicate TxID instead of double-crediting, so a poller or client retry
+// is safe to replay.
+func AccrualTxID(key string) string {
+	return "accrual:" + key
+}
+
+// WithdrawalTxID derives the transaction id for an idempotent withdrawal
+// keyed by key, with the same replay-safety as AccrualTxID.
+func WithdrawalTxID(key string) string {
+	return "withdrawal:" + key
+}
+
+// NewAccrualTransaction credits a user's available account for amount,
+// funded by the system accrual account for order.
+func NewAccrualTransaction(txid, username, order string, amount float64) Transaction {
+	return Transaction{
+		TxID:  txid,
+		Order: order,
+		Kind:  KindAccrual,
+		Postings: []Posting{
+			{Account: AccrualAccount(order), Amount: -amount},
+			{Account: AvailableAccount(username), Amount: amount},
+		},
+	}
+}
+
+// NewWithdrawalTransaction moves amount out of a user's available account
+// into their spent account.
+func NewWithdrawalTransaction(txid, username, order string, amount float64) Transaction {
+	return Transaction{
+		TxID:  txid,
+		Order: order,
+		Kind:  KindWithdrawal,
+		Postings: []Posting{
+			{Account: AvailableAccount(username), Amount: -amount},
+			{Account: SpentAccount(username), Amount: amount},
+		},
+	}
+}
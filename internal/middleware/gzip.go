@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponseWriter wraps http.ResponseWriter so Write goes through a
+// gzip.Writer instead of straight to the wire.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.writer.Write(data)
+}
+
+// GzipMiddleware gzip-compresses the response body when the client sends
+// Accept-Encoding: gzip, leaving it untouched otherwise. Request-body
+// decompression is handled separately by handler.DecompressBody, which also
+// bounds the inflated size - this middleware only ever compresses what the
+// server itself writes, so there's no equivalent bomb risk here.
+func GzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		gzipWriter := gzip.NewWriter(w)
+		defer gzipWriter.Close()
+
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, writer: gzipWriter}, r)
+	})
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import "net/http"
+
+// MaxBytesMiddleware caps a request's body at limit bytes on the wire by
+// wrapping it in http.MaxBytesReader: a handler reading past limit gets an
+// *http.MaxBytesError, which it renders as 413. A
+// compressed payload's inflated size is bounded separately by
+// handler.DecompressBody, since a gzip bomb can blow past a tiny wire-size
+// cap once decompressed.
+func MaxBytesMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
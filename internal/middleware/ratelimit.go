@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/render"
+)
+
+// bucket tracks one client's remaining requests for the current window; it
+// resets to limit tokens once windowEnd passes instead of a rolling average.
+type bucket struct {
+	tokens    int
+	windowEnd time.Time
+}
+
+// rateLimitSweepThreshold is how many tracked IPs accumulate before
+// RateLimitMiddleware sweeps expired buckets, so a long-running process
+// hammered from many IPs doesn't grow the map forever.
+const rateLimitSweepThreshold = 1024
+
+// RateLimitMiddleware rejects a client IP's requests past limit per window
+// with 429 and a Retry-After header. It's meant for small public endpoints
+// (like a username-availability check) that would otherwise double as a
+// user-enumeration oracle for anyone hammering them.
+func RateLimitMiddleware(limit int, window time.Duration) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	buckets := make(map[string]*bucket)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+
+			mu.Lock()
+			now := time.Now()
+			b, ok := buckets[ip]
+			if !ok || !now.Before(b.windowEnd) {
+				if !ok && len(buckets) >= rateLimitSweepThreshold {
+					for k, v := range buckets {
+						if !now.Before(v.windowEnd) {
+							delete(buckets, k)
+						}
+					}
+				}
+				b = &bucket{tokens: limit, windowEnd: now.Add(window)}
+				buckets[ip] = b
+			}
+			allowed := b.tokens > 0
+			if allowed {
+				b.tokens--
+			}
+			retryAfter := b.windowEnd.Sub(now)
+			mu.Unlock()
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				render.Write(w, r, http.StatusTooManyRequests, "rate_limited", "Too Many Requests", "Too many requests, try again later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP deliberately ignores X-Forwarded-For/X-Real-IP: trusting them
+// without a configured trusted-proxy list would let a client spoof its way
+// past the limiter entirely, which is worse than the coarser RemoteAddr.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,409 @@
+// Package migration creates the tables DBStorage and sqlitestore.Storage
+// query against. There is no migration history table or up/down steps: every
+// statement is an idempotent CREATE TABLE IF NOT EXISTS, so RunMigrations is
+// safe to call on every startup.
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// legacyTimeLayout matches sqlitestore's own timeLayout, for parsing
+// processed_at out of a pre-ledger SQLite deployment's loyalty_transactions
+// rows.
+const legacyTimeLayout = time.RFC3339Nano
+
+// Dialect identifies which SQL variant a DSN targets. PostgreSQL and SQLite
+// disagree on timestamp defaults, RETURNING availability, and placeholder
+// syntax, so each gets its own statement set.
+type Dialect string
+
+const (
+	DialectPostgres Dialect = "postgres"
+	DialectSQLite   Dialect = "sqlite"
+)
+
+// DetectDialect infers the dialect from a DSN: a postgres/postgresql scheme
+// is PostgreSQL, everything else (a file path, ":memory:", "file::memory:")
+// is treated as a SQLite DSN.
+func DetectDialect(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return DialectPostgres
+	}
+	return DialectSQLite
+}
+
+func driverName(dialect Dialect) string {
+	if dialect == DialectSQLite {
+		return "sqlite"
+	}
+	return "pgx"
+}
+
+var statements = map[Dialect][]string{
+	DialectPostgres: {
+		`CREATE TABLE IF NOT EXISTS users (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS orders (
+			order_number TEXT PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id),
+			status TEXT NOT NULL,
+			accrual DOUBLE PRECISION,
+			uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS transactions (
+			txid TEXT PRIMARY KEY,
+			order_number TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			metadata JSONB,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS postings (
+			id BIGSERIAL PRIMARY KEY,
+			txid TEXT NOT NULL REFERENCES transactions(txid),
+			account TEXT NOT NULL,
+			amount DOUBLE PRECISION NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS accrual_poll_jobs (
+			order_number TEXT PRIMARY KEY,
+			next_attempt_at TIMESTAMPTZ NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			state TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			credential_id BYTEA PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id),
+			public_key BYTEA NOT NULL,
+			sign_count BIGINT NOT NULL,
+			aaguid BYTEA,
+			transports JSONB,
+			attestation_json BYTEA,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_sessions (
+			session_id TEXT PRIMARY KEY,
+			data BYTEA NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS federated_identities (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id),
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (provider, subject)
+		)`,
+		`CREATE INDEX IF NOT EXISTS federated_identities_email_idx ON federated_identities (email)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id BIGSERIAL PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id),
+			token_hash TEXT UNIQUE NOT NULL,
+			access_jti TEXT NOT NULL,
+			issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			revoked_at TIMESTAMPTZ,
+			user_agent TEXT,
+			ip TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id)`,
+		`CREATE TABLE IF NOT EXISTS revoked_access_jti (
+			jti TEXT PRIMARY KEY,
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS health_probes (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+	},
+	DialectSQLite: {
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS orders (
+			order_number TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			status TEXT NOT NULL,
+			accrual REAL,
+			uploaded_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS transactions (
+			txid TEXT PRIMARY KEY,
+			order_number TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			metadata TEXT,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS postings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			txid TEXT NOT NULL REFERENCES transactions(txid),
+			account TEXT NOT NULL,
+			amount REAL NOT NULL,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS accrual_poll_jobs (
+			order_number TEXT PRIMARY KEY,
+			next_attempt_at TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			state TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			credential_id BLOB PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			public_key BLOB NOT NULL,
+			sign_count INTEGER NOT NULL,
+			aaguid BLOB,
+			transports TEXT,
+			attestation_json BLOB,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_sessions (
+			session_id TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS federated_identities (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT,
+			created_at TEXT NOT NULL,
+			UNIQUE (provider, subject)
+		)`,
+		`CREATE INDEX IF NOT EXISTS federated_identities_email_idx ON federated_identities (email)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			token_hash TEXT UNIQUE NOT NULL,
+			access_jti TEXT NOT NULL,
+			issued_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			revoked_at TEXT,
+			user_agent TEXT,
+			ip TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id)`,
+		`CREATE TABLE IF NOT EXISTS revoked_access_jti (
+			jti TEXT PRIMARY KEY,
+			expires_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS health_probes (
+			id TEXT PRIMARY KEY,
+			created_at TEXT NOT NULL
+		)`,
+	},
+}
+
+// RunMigrations creates any tables missing for dsn's dialect, inferred by
+// DetectDialect, on a throwaway connection. For an on-disk or networked
+// database that's fine: the effect of the statements outlives the
+// connection. It must not be used for a SQLite ":memory:" DSN, whose
+// tables disappear the moment this connection closes — RunOn exists for
+// callers (sqlitestore) that have to migrate on their own long-lived pool.
+func RunMigrations(ctx context.Context, dsn string, logger *zap.SugaredLogger) error {
+	dialect := DetectDialect(dsn)
+
+	db, err := sql.Open(driverName(dialect), dsn)
+	if err != nil {
+		return fmt.Errorf("error opening database for migrations: %w", err)
+	}
+	defer db.Close()
+
+	if err := RunOn(ctx, db, dialect); err != nil {
+		return err
+	}
+
+	logger.Infow("Migrations applied", "dialect", dialect)
+	return nil
+}
+
+// RunOn creates any tables missing for dialect on an already-open db,
+// without opening or closing a connection of its own.
+func RunOn(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	for _, stmt := range statements[dialect] {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("error running migration: %w", err)
+		}
+	}
+	if err := backfillLedgerFromLegacyTables(ctx, db, dialect); err != nil {
+		return fmt.Errorf("error backfilling ledger from legacy tables: %w", err)
+	}
+	return nil
+}
+
+// backfillLedgerFromLegacyTables migrates a pre-ledger deployment's
+// loyalty_transactions rows (the scalar user_balance model chunk0-2
+// replaced with double-entry postings/transactions) into the ledger. It's
+// a no-op on a deployment that never had the legacy table, or one that's
+// already been backfilled.
+func backfillLedgerFromLegacyTables(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	hasLegacy, err := tableExists(ctx, db, dialect, "loyalty_transactions")
+	if err != nil {
+		return fmt.Errorf("error checking for legacy loyalty_transactions table: %w", err)
+	}
+	if !hasLegacy {
+		return nil
+	}
+
+	var postingCount int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM postings").Scan(&postingCount); err != nil {
+		return fmt.Errorf("error checking existing postings: %w", err)
+	}
+	if postingCount > 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.username, lt.order_number, lt.transaction_type, lt.points, lt.processed_at
+		FROM loyalty_transactions lt
+		INNER JOIN users u ON u.id = lt.user_id
+	`)
+	if err != nil {
+		return fmt.Errorf("error reading legacy loyalty_transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var legacyTransactions []ledger.Transaction
+	for rows.Next() {
+		var username, orderNumber, transactionType string
+		var points float64
+		var processedAtRaw any
+		if err := rows.Scan(&username, &orderNumber, &transactionType, &points, &processedAtRaw); err != nil {
+			return fmt.Errorf("error scanning legacy loyalty transaction: %w", err)
+		}
+
+		processedAt, err := parseLegacyTime(processedAtRaw)
+		if err != nil {
+			return fmt.Errorf("error parsing legacy transaction timestamp: %w", err)
+		}
+
+		switch transactionType {
+		case "earn":
+			txn := ledger.NewAccrualTransaction(ledger.AccrualTxID(orderNumber), username, orderNumber, points)
+			legacyTransactions = append(legacyTransactions, withCreatedAt(txn, processedAt))
+		case "spend":
+			txn := ledger.NewWithdrawalTransaction(ledger.WithdrawalTxID(orderNumber), username, orderNumber, points)
+			legacyTransactions = append(legacyTransactions, withCreatedAt(txn, processedAt))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating legacy loyalty transactions: %w", err)
+	}
+
+	for _, txn := range legacyTransactions {
+		if err := insertBackfilledTransaction(ctx, db, dialect, txn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withCreatedAt stashes processedAt in Metadata so insertBackfilledTransaction
+// can preserve the original timestamp instead of stamping "now".
+func withCreatedAt(txn ledger.Transaction, processedAt time.Time) ledger.Transaction {
+	txn.Metadata = map[string]interface{}{"backfilled_created_at": processedAt}
+	return txn
+}
+
+// parseLegacyTime normalizes a scanned processed_at value to time.Time: pgx
+// hands back a time.Time directly for TIMESTAMPTZ, while SQLite's TEXT
+// column comes back as a string or []byte in legacyTimeLayout.
+func parseLegacyTime(raw any) (time.Time, error) {
+	switch v := raw.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		return time.Parse(legacyTimeLayout, string(v))
+	case string:
+		return time.Parse(legacyTimeLayout, v)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported processed_at type %T", raw)
+	}
+}
+
+// insertBackfilledTransaction writes one legacy-derived transaction header
+// and its postings, skipping it if that TxID was already posted (the
+// ON CONFLICT/INSERT OR IGNORE a retried backfill run would otherwise hit).
+func insertBackfilledTransaction(ctx context.Context, db *sql.DB, dialect Dialect, txn ledger.Transaction) error {
+	createdAt, _ := txn.Metadata["backfilled_created_at"].(time.Time)
+
+	if dialect == DialectPostgres {
+		result, err := db.ExecContext(ctx, `
+			INSERT INTO transactions (txid, order_number, kind, metadata, created_at)
+			VALUES ($1, $2, $3, '{}', $4)
+			ON CONFLICT (txid) DO NOTHING
+		`, txn.TxID, txn.Order, txn.Kind, createdAt)
+		if err != nil {
+			return fmt.Errorf("error inserting backfilled transaction header: %w", err)
+		}
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			return err
+		}
+		for _, posting := range txn.Postings {
+			if _, err := db.ExecContext(ctx, `
+				INSERT INTO postings (txid, account, amount, created_at)
+				VALUES ($1, $2, $3, $4)
+			`, txn.TxID, posting.Account, posting.Amount, createdAt); err != nil {
+				return fmt.Errorf("error inserting backfilled posting: %w", err)
+			}
+		}
+		return nil
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO transactions (txid, order_number, kind, metadata, created_at)
+		VALUES (?, ?, ?, '{}', ?)
+	`, txn.TxID, txn.Order, txn.Kind, createdAt.Format(legacyTimeLayout))
+	if err != nil {
+		return fmt.Errorf("error inserting backfilled transaction header: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+	for _, posting := range txn.Postings {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO postings (txid, account, amount, created_at)
+			VALUES (?, ?, ?, ?)
+		`, txn.TxID, posting.Account, posting.Amount, createdAt.Format(legacyTimeLayout)); err != nil {
+			return fmt.Errorf("error inserting backfilled posting: %w", err)
+		}
+	}
+	return nil
+}
+
+// tableExists reports whether name exists in dialect's catalog.
+func tableExists(ctx context.Context, db *sql.DB, dialect Dialect, name string) (bool, error) {
+	var query string
+	if dialect == DialectPostgres {
+		query = "SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = $1)"
+	} else {
+		query = "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)"
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, query, name).Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
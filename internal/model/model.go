@@ -35,3 +35,38 @@ type AccrualResponse struct {
 	Status  string   `json:"status"`
 	Accrual *float64 `json:"accrual,omitempty"`
 }
+
+// PollJob is a pending accrual-poll job claimed from accrual_poll_jobs.
+type PollJob struct {
+	OrderNumber   string
+	NextAttemptAt time.Time
+	Attempts      int
+	State         string
+}
+
+// WebAuthnCredential is a passkey/hardware key bound to a user account,
+// stored in webauthn_credentials.
+type WebAuthnCredential struct {
+	CredentialID    []byte
+	PublicKey       []byte
+	SignCount       uint32
+	AAGUID          []byte
+	Transports      []string
+	AttestationJSON []byte
+}
+
+// RefreshSession is one refresh-token lineage tied to the access token it
+// was issued alongside (AccessJTI), stored in refresh_tokens. Revoking it
+// stops it from minting further access tokens; pairing that with
+// RevokeAccessJTI kills the in-flight access token too instead of leaving it
+// valid until its natural expiry.
+type RefreshSession struct {
+	Username  string     `json:"-"`
+	TokenHash string     `json:"-"`
+	AccessJTI string     `json:"jti"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	UserAgent string     `json:"user_agent"`
+	IP        string     `json:"ip"`
+}
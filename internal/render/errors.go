@@ -0,0 +1,53 @@
+package render
+
+import (
+	"errors"
+	"net/http"
+
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+)
+
+// sentinelProblem is the canonical problem document for an apperrors
+// sentinel, used where the sentinel's HTTP status doesn't vary by caller.
+// Where it does (the same sentinel meaning something different in two
+// handlers), the handler renders that case with Write instead of Error.
+type sentinelProblem struct {
+	status int
+	code   string
+	title  string
+	detail string
+}
+
+var sentinelProblems = []struct {
+	err error
+	sentinelProblem
+}{
+	{apperrors.ErrUserAlreadyExists, sentinelProblem{http.StatusConflict, "user_already_exists", "Conflict", "User already exists"}},
+	{apperrors.ErrOrderOwnedByAnotherUser, sentinelProblem{http.StatusConflict, "order_owned_by_another_user", "Conflict", "Order already exists"}},
+	{apperrors.ErrInvalidRequest, sentinelProblem{http.StatusBadRequest, "invalid_request", "Bad Request", "Invalid request format"}},
+	{apperrors.ErrPasswordHashing, sentinelProblem{http.StatusInternalServerError, "password_hashing_failed", "Internal Server Error", "Internal server error"}},
+	{apperrors.ErrDatabaseOperation, sentinelProblem{http.StatusInternalServerError, "database_error", "Internal Server Error", "Internal server error"}},
+	{apperrors.ErrBalanceNotFound, sentinelProblem{http.StatusInternalServerError, "balance_not_found", "Internal Server Error", "User balance not found"}},
+	{apperrors.ErrInsufficientFunds, sentinelProblem{http.StatusPaymentRequired, "insufficient_funds", "Payment Required", "Insufficient funds"}},
+	{apperrors.ErrWebAuthnSessionNotFound, sentinelProblem{http.StatusBadRequest, "webauthn_session_not_found", "Bad Request", "Invalid or expired session"}},
+	{apperrors.ErrPayloadTooLarge, sentinelProblem{http.StatusRequestEntityTooLarge, "payload_too_large", "Request Entity Too Large", "Request payload exceeds the allowed size"}},
+	{apperrors.ErrInvalidUsername, sentinelProblem{http.StatusBadRequest, "invalid_username", "Bad Request", "Invalid username format"}},
+	{apperrors.ErrRefreshTokenReused, sentinelProblem{http.StatusUnauthorized, "refresh_token_reused", "Unauthorized", "Refresh token already used, all sessions revoked"}},
+	{apperrors.ErrRefreshTokenExpired, sentinelProblem{http.StatusUnauthorized, "refresh_token_expired", "Unauthorized", "Refresh token expired"}},
+	{apperrors.ErrRefreshTokenNotFound, sentinelProblem{http.StatusUnauthorized, "refresh_token_invalid", "Unauthorized", "Invalid refresh token"}},
+	{apperrors.ErrFederatedIdentityLinked, sentinelProblem{http.StatusConflict, "federated_identity_linked", "Conflict", "This provider identity is already linked to another account"}},
+}
+
+// Error renders err as a problem document, consulting sentinelProblems for
+// one of this API's known apperrors.* sentinels and otherwise falling back
+// to a generic 500 "internal_error" - the same default the ad-hoc
+// http.Error(w, "Internal server error", 500) calls this replaces used.
+func Error(w http.ResponseWriter, r *http.Request, err error) {
+	for _, sp := range sentinelProblems {
+		if errors.Is(err, sp.err) {
+			Write(w, r, sp.status, sp.code, sp.title, sp.detail)
+			return
+		}
+	}
+	Write(w, r, http.StatusInternalServerError, "internal_error", "Internal Server Error", "Internal server error")
+}
@@ -3,11 +3,19 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strings"
+	"time"
 
 	"github.com/Schera-ole/loyalty_system/internal/auth"
 	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
 	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
@@ -15,6 +23,71 @@ type DBStorage struct {
 	db *sql.DB
 }
 
+// Postgres error codes that mean the serializable transaction lost a race
+// with a concurrent one and should simply be retried.
+const (
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+const (
+	txRetryMaxAttempts = 5
+	txRetryBaseDelay   = 10 * time.Millisecond
+)
+
+// withTxRetry runs fn inside a sql.LevelSerializable transaction, committing
+// on success and rolling back otherwise. A serialization failure or deadlock
+// is retried with exponential backoff and jitter, for at most
+// txRetryMaxAttempts attempts in all; any other error from fn is returned
+// immediately.
+func (storage *DBStorage) withTxRetry(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	delay := txRetryBaseDelay
+	var err error
+	for attempt := 0; attempt < txRetryMaxAttempts; attempt++ {
+		if err = storage.runInTx(ctx, fn); err == nil || !isRetryableTxError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay + time.Duration(rand.Int63n(int64(delay)+1))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	return err
+}
+
+// runInTx begins a single serializable transaction, invokes fn, and commits
+// or rolls back based on its result.
+func (storage *DBStorage) runInTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := storage.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit transaction: %w", err)
+	}
+	return nil
+}
+
+// isRetryableTxError reports whether err is a Postgres serialization failure
+// or deadlock, both of which are safe to retry from the start of the
+// transaction.
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected
+}
+
 func NewDBStorage(dsn string) (*DBStorage, error) {
 	dbConnect, err := sql.Open("pgx", dsn)
 	if err != nil {
@@ -33,48 +106,31 @@ func (storage *DBStorage) SetUser(ctx context.Context, user model.User) error {
 		return apperrors.ErrInvalidRequest
 	}
 
-	tx, err := storage.db.Begin()
-	if err != nil {
-		return fmt.Errorf("can't start transaction: %w", err)
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-
-	// Check if user already exists before attempting to create
-	exists, err := storage.checkUserExists(ctx, tx, user.Username)
-	if err != nil {
-		return fmt.Errorf("error checking user existence: %w", err)
-	}
-	if exists {
-		return apperrors.ErrUserAlreadyExists
-	}
-
 	passwordHash, err := auth.HashPassword(user.Password)
 	if err != nil {
 		return apperrors.ErrPasswordHashing
 	}
 
-	// Insert user
-	query := "INSERT INTO users (username, password_hash, created_at, updated_at) VALUES ($1, $2, NOW(), NOW()) RETURNING id"
-	var userID string
-	err = tx.QueryRowContext(ctx, query, user.Username, passwordHash).Scan(&userID)
-	if err != nil {
-		return fmt.Errorf("error saving user: %w", err)
-	}
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		// Check if user already exists before attempting to create
+		exists, err := storage.checkUserExists(ctx, tx, user.Username)
+		if err != nil {
+			return fmt.Errorf("error checking user existence: %w", err)
+		}
+		if exists {
+			return apperrors.ErrUserAlreadyExists
+		}
 
-	// Create user balance record with default values
-	balanceQuery := "INSERT INTO user_balance (user_id, balance, total_spent, updated_at) VALUES ($1, 0, 0, NOW())"
-	_, err = tx.Exec(balanceQuery, userID)
-	if err != nil {
-		return fmt.Errorf("error creating user balance: %w", err)
-	}
+		// Insert user. Their ledger balance starts at zero implicitly: no
+		// postings exist yet for users/<username>/available.
+		query := "INSERT INTO users (username, password_hash, created_at, updated_at) VALUES ($1, $2, NOW(), NOW()) RETURNING id"
+		var userID string
+		if err := tx.QueryRowContext(ctx, query, user.Username, passwordHash).Scan(&userID); err != nil {
+			return fmt.Errorf("error saving user: %w", err)
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func (storage *DBStorage) CheckUser(ctx context.Context, user model.User) (bool, error) {
@@ -103,6 +159,15 @@ func (storage *DBStorage) CheckUser(ctx context.Context, user model.User) (bool,
 	return true, nil
 }
 
+func (storage *DBStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)"
+	if err := storage.db.QueryRowContext(ctx, query, username).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking if user exists: %w", err)
+	}
+	return exists, nil
+}
+
 func (storage *DBStorage) GetOrders(ctx context.Context, username string) ([]model.Order, error) {
 	var orders []model.Order
 	query := `
@@ -139,15 +204,19 @@ func (storage *DBStorage) GetOrders(ctx context.Context, username string) ([]mod
 	return orders, nil
 }
 
+// GetUserBalance sums the postings against the user's available and spent
+// accounts. It is driven off the users table so a nonexistent user still
+// yields ErrBalanceNotFound instead of a zero balance.
 func (storage *DBStorage) GetUserBalance(ctx context.Context, username string) (model.UserBalance, error) {
 	var userBalance model.UserBalance
 	query := `
-		SELECT ub.balance, ub.total_spent
-		FROM user_balance ub
-		INNER JOIN users u ON ub.user_id = u.id
-		WHERE u.username = $1
+		SELECT
+			COALESCE((SELECT SUM(amount) FROM postings WHERE account = $1), 0),
+			COALESCE((SELECT SUM(amount) FROM postings WHERE account = $2), 0)
+		FROM users WHERE username = $3
 	`
-	err := storage.db.QueryRowContext(ctx, query, username).Scan(&userBalance.Balance, &userBalance.TotalSpent)
+	err := storage.db.QueryRowContext(ctx, query, ledger.AvailableAccount(username), ledger.SpentAccount(username), username).
+		Scan(&userBalance.Balance, &userBalance.TotalSpent)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return userBalance, apperrors.ErrBalanceNotFound
@@ -157,16 +226,18 @@ func (storage *DBStorage) GetUserBalance(ctx context.Context, username string) (
 	return userBalance, nil
 }
 
+// GetWithdrawals lists withdrawal-kind transactions that posted against the
+// user's spent account.
 func (storage *DBStorage) GetWithdrawals(ctx context.Context, username string) ([]model.Withdrawal, error) {
 	var withdrawals []model.Withdrawal
 	query := `
-		SELECT lt.order_number, lt.points, lt.processed_at
-		FROM loyalty_transactions lt
-		INNER JOIN users u ON lt.user_id = u.id
-		WHERE u.username = $1 AND lt.transaction_type = 'spend'
-		ORDER BY lt.processed_at DESC
+		SELECT t.order_number, p.amount, t.created_at
+		FROM transactions t
+		INNER JOIN postings p ON p.txid = t.txid AND p.account = $1
+		WHERE t.kind = 'withdrawal'
+		ORDER BY t.created_at DESC
 	`
-	rows, err := storage.db.QueryContext(ctx, query, username)
+	rows, err := storage.db.QueryContext(ctx, query, ledger.SpentAccount(username))
 	if err != nil {
 		return withdrawals, fmt.Errorf("error executing query: %w", err)
 	}
@@ -192,10 +263,206 @@ func (storage *DBStorage) GetWithdrawals(ctx context.Context, username string) (
 	return withdrawals, nil
 }
 
+// SpendPoints posts a withdrawal transaction, asserting inside the same
+// transaction that the user's available balance covers it.
 func (storage *DBStorage) SpendPoints(ctx context.Context, orderWithdrawal model.OrderWithdrawal) error {
-	var currentBalance float64
-	var userID string
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
 
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists); err != nil {
+			return fmt.Errorf("error checking user existence: %w", err)
+		}
+		if !exists {
+			return apperrors.ErrBalanceNotFound
+		}
+
+		availableAccount := ledger.AvailableAccount(username)
+		var currentBalance float64
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account = $1", availableAccount).Scan(&currentBalance); err != nil {
+			return fmt.Errorf("error checking user balance: %w", err)
+		}
+
+		if orderWithdrawal.Sum > currentBalance {
+			return apperrors.ErrInsufficientFunds
+		}
+
+		txn := ledger.NewWithdrawalTransaction(uuid.NewString(), username, orderWithdrawal.Order, orderWithdrawal.Sum)
+		return insertLedgerTransaction(ctx, tx, txn)
+	})
+}
+
+// SpendPointsIdempotent is SpendPoints keyed by an idempotency key: a
+// retried request with the same key finds its transaction already posted
+// and returns success without re-checking or re-debiting the balance.
+func (storage *DBStorage) SpendPointsIdempotent(ctx context.Context, key string, orderWithdrawal model.OrderWithdrawal) error {
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
+	txid := ledger.WithdrawalTxID(key)
+
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists); err != nil {
+			return fmt.Errorf("error checking user existence: %w", err)
+		}
+		if !exists {
+			return apperrors.ErrBalanceNotFound
+		}
+
+		var alreadyPosted bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM transactions WHERE txid = $1)", txid).Scan(&alreadyPosted); err != nil {
+			return fmt.Errorf("error checking idempotency key: %w", err)
+		}
+		if alreadyPosted {
+			return nil
+		}
+
+		availableAccount := ledger.AvailableAccount(username)
+		var currentBalance float64
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account = $1", availableAccount).Scan(&currentBalance); err != nil {
+			return fmt.Errorf("error checking user balance: %w", err)
+		}
+
+		if orderWithdrawal.Sum > currentBalance {
+			return apperrors.ErrInsufficientFunds
+		}
+
+		txn := ledger.NewWithdrawalTransaction(txid, username, orderWithdrawal.Order, orderWithdrawal.Sum)
+		return insertLedgerTransaction(ctx, tx, txn)
+	})
+}
+
+// CreditAccrualIdempotent is the credit half of UpdateOrderStatusAndAccrual,
+// exposed directly so a caller can retry crediting a PROCESSED order without
+// going through a full status update, and without double-crediting on
+// retry. CompletePollJob posts the same credit inline for the combined
+// status-update-plus-credit path; both route through creditAccrualPosting
+// so the two can't drift out of sync.
+func (storage *DBStorage) CreditAccrualIdempotent(ctx context.Context, key string, orderNumber string, amount float64) error {
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		username, err := usernameForOrder(ctx, tx, orderNumber)
+		if err != nil {
+			return err
+		}
+		return creditAccrualPosting(ctx, tx, ledger.AccrualTxID(key), username, orderNumber, amount)
+	})
+}
+
+// usernameForOrder looks up the username owning orderNumber, for the
+// accrual-crediting paths that need it inside an open transaction.
+func usernameForOrder(ctx context.Context, tx *sql.Tx, orderNumber string) (string, error) {
+	var username string
+	query := `
+		SELECT u.username FROM orders o
+		INNER JOIN users u ON o.user_id = u.id
+		WHERE o.order_number = $1
+	`
+	if err := tx.QueryRowContext(ctx, query, orderNumber).Scan(&username); err != nil {
+		return "", fmt.Errorf("error getting user for order: %w", err)
+	}
+	return username, nil
+}
+
+// creditAccrualPosting posts an accrual credit transaction keyed by txid, so
+// calling it twice for the same key (e.g. a retried status update) can't
+// double-credit the order.
+func creditAccrualPosting(ctx context.Context, tx *sql.Tx, txid string, username string, orderNumber string, amount float64) error {
+	txn := ledger.NewAccrualTransaction(txid, username, orderNumber, amount)
+	return insertLedgerTransaction(ctx, tx, txn)
+}
+
+// RecomputeBalance re-derives a user's balance straight from the ledger.
+// GetUserBalance already computes it this way on every call instead of from
+// a cache, so this is the same query exposed as its own entrypoint for
+// reconciliation tooling to assert the two agree.
+func (storage *DBStorage) RecomputeBalance(ctx context.Context, username string) (model.UserBalance, error) {
+	return storage.GetUserBalance(ctx, username)
+}
+
+// AddOrder adds a new order for a user
+func (storage *DBStorage) AddOrder(ctx context.Context, username string, orderNumber string) error {
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		// Get user ID
+		var userID string
+		query := "SELECT id FROM users WHERE username = $1"
+		if err := tx.QueryRowContext(ctx, query, username).Scan(&userID); err != nil {
+			if err == sql.ErrNoRows {
+				return apperrors.ErrUserNotFound
+			}
+			return fmt.Errorf("error getting user ID: %w", err)
+		}
+
+		// Check if order already exists for any user
+		var existingUserID string
+		checkOrderQuery := "SELECT user_id FROM orders WHERE order_number = $1"
+		err := tx.QueryRowContext(ctx, checkOrderQuery, orderNumber).Scan(&existingUserID)
+		if err == nil {
+			// Order exists, check if it's for the same user
+			if existingUserID == userID {
+				return apperrors.ErrOrderAlreadyExists
+			}
+			// Order exists for different user
+			return apperrors.ErrOrderOwnedByAnotherUser
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("error checking order existence: %w", err)
+		}
+
+		// Insert order
+		insertQuery := "INSERT INTO orders (order_number, user_id, status, uploaded_at) VALUES ($1, $2, 'NEW', NOW())"
+		if _, err := tx.ExecContext(ctx, insertQuery, orderNumber, userID); err != nil {
+			return fmt.Errorf("error inserting order: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// UpdateOrderStatus updates the status of an order
+func (storage *DBStorage) UpdateOrderStatus(ctx context.Context, orderNumber string, status string) error {
+	query := "UPDATE orders SET status = $1, updated_at = NOW() WHERE order_number = $2"
+	_, err := storage.db.ExecContext(ctx, query, status, orderNumber)
+	if err != nil {
+		return fmt.Errorf("error updating order status: %w", err)
+	}
+	return nil
+}
+
+// UpdateOrderStatusAndAccrual updates the status and accrual of an order
+func (storage *DBStorage) UpdateOrderStatusAndAccrual(ctx context.Context, orderNumber string, status string, accrual *float64) error {
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		username, err := usernameForOrder(ctx, tx, orderNumber)
+		if err != nil {
+			return err
+		}
+
+		// Update order status and accrual
+		updateOrderQuery := "UPDATE orders SET status = $1, accrual = $2, updated_at = NOW() WHERE order_number = $3"
+		if _, err := tx.ExecContext(ctx, updateOrderQuery, status, accrual, orderNumber); err != nil {
+			return fmt.Errorf("error updating order status and accrual: %w", err)
+		}
+
+		// If order is processed with accrual, credit the user's ledger
+		// balance. The TxID is keyed by order number, not randomly
+		// generated, so calling this twice for the same order (e.g. a
+		// retried status update) can't double-credit it.
+		if status == "PROCESSED" && accrual != nil && *accrual > 0 {
+			if err := creditAccrualPosting(ctx, tx, ledger.AccrualTxID(orderNumber), username, orderNumber, *accrual); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// PostTransaction atomically writes a ledger transaction header and its
+// postings.
+func (storage *DBStorage) PostTransaction(ctx context.Context, transaction ledger.Transaction) error {
 	tx, err := storage.db.Begin()
 	if err != nil {
 		return fmt.Errorf("can't start transaction: %w", err)
@@ -208,52 +475,117 @@ func (storage *DBStorage) SpendPoints(ctx context.Context, orderWithdrawal model
 		}
 	}()
 
-	// Get user ID and current balance
-	queryUserBalance := `
-		SELECT u.id, ub.balance
-		FROM user_balance ub
-		INNER JOIN users u ON ub.user_id = u.id
-		WHERE u.username = $1
+	return insertLedgerTransaction(ctx, tx, transaction)
+}
+
+// insertLedgerTransaction writes the transaction header and its postings
+// within an already-open *sql.Tx. A header insert that collides with an
+// already-posted TxID is treated as a successful replay rather than an
+// error, so callers that derive TxID deterministically (ledger.AccrualTxID,
+// ledger.WithdrawalTxID) get idempotent posting for free.
+func insertLedgerTransaction(ctx context.Context, tx *sql.Tx, transaction ledger.Transaction) error {
+	metadata, err := json.Marshal(transaction.Metadata)
+	if err != nil {
+		return fmt.Errorf("error marshaling transaction metadata: %w", err)
+	}
+
+	insertHeaderQuery := `
+		INSERT INTO transactions (txid, order_number, kind, metadata, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (txid) DO NOTHING
 	`
-	err = tx.QueryRowContext(ctx, queryUserBalance, orderWithdrawal.User).Scan(&userID, &currentBalance)
+	result, err := tx.ExecContext(ctx, insertHeaderQuery, transaction.TxID, transaction.Order, transaction.Kind, metadata)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return apperrors.ErrBalanceNotFound
-		}
-		return fmt.Errorf("error checking user balance: %w", err)
+		return fmt.Errorf("error inserting transaction header: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error checking transaction insert: %w", err)
+	} else if rows == 0 {
+		return nil
 	}
 
-	// Check if user has sufficient balance
-	if float64(orderWithdrawal.Sum) > currentBalance {
-		return apperrors.ErrInsufficientFunds
+	insertPostingQuery := `INSERT INTO postings (txid, account, amount, created_at) VALUES ($1, $2, $3, NOW())`
+	for _, posting := range transaction.Postings {
+		if _, err := tx.ExecContext(ctx, insertPostingQuery, transaction.TxID, posting.Account, posting.Amount); err != nil {
+			return fmt.Errorf("error inserting posting: %w", err)
+		}
 	}
 
-	// Update user balance
-	updateBalanceQuery := `
-		UPDATE user_balance
-		SET balance = balance - $1, total_spent = total_spent + $1, updated_at = NOW()
-		WHERE user_id = $2
+	return nil
+}
+
+// EnqueuePollJob schedules an accrual-poll job for orderNumber, due immediately.
+func (storage *DBStorage) EnqueuePollJob(ctx context.Context, orderNumber string) error {
+	query := `
+		INSERT INTO accrual_poll_jobs (order_number, next_attempt_at, attempts, state)
+		VALUES ($1, NOW(), 0, 'PENDING')
+		ON CONFLICT (order_number) DO NOTHING
 	`
-	_, err = tx.ExecContext(ctx, updateBalanceQuery, float64(orderWithdrawal.Sum), userID)
+	_, err := storage.db.ExecContext(ctx, query, orderNumber)
+	if err != nil {
+		return fmt.Errorf("error enqueueing poll job: %w", err)
+	}
+	return nil
+}
+
+// ClaimDuePollJobs claims up to limit due jobs, locking the rows so other
+// replicas draining the same table skip them.
+func (storage *DBStorage) ClaimDuePollJobs(ctx context.Context, limit int) ([]model.PollJob, error) {
+	tx, err := storage.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error updating user balance: %w", err)
+		return nil, fmt.Errorf("can't start transaction: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
 
-	// Create loyalty transaction record
-	insertTransactionQuery := `
-		INSERT INTO loyalty_transactions (user_id, order_number, points, transaction_type, processed_at)
-		VALUES ($1, $2, $3, 'spend', NOW())
+	query := `
+		SELECT order_number, next_attempt_at, attempts, state
+		FROM accrual_poll_jobs
+		WHERE next_attempt_at <= NOW() AND state = 'PENDING'
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
 	`
-	_, err = tx.ExecContext(ctx, insertTransactionQuery, userID, orderWithdrawal.Order, float64(orderWithdrawal.Sum))
+	rows, err := tx.QueryContext(ctx, query, limit)
 	if err != nil {
-		return fmt.Errorf("error creating loyalty transaction: %w", err)
+		return nil, fmt.Errorf("error claiming poll jobs: %w", err)
 	}
+	defer rows.Close()
 
-	return nil
+	var jobs []model.PollJob
+	for rows.Next() {
+		var job model.PollJob
+		if err = rows.Scan(&job.OrderNumber, &job.NextAttemptAt, &job.Attempts, &job.State); err != nil {
+			return nil, fmt.Errorf("error scanning poll job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating poll jobs: %w", err)
+	}
+
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+
+	claimQuery := `UPDATE accrual_poll_jobs SET state = 'CLAIMED' WHERE order_number = $1`
+	for _, job := range jobs {
+		if _, err = tx.ExecContext(ctx, claimQuery, job.OrderNumber); err != nil {
+			return nil, fmt.Errorf("error marking poll job claimed: %w", err)
+		}
+	}
+
+	return jobs, nil
 }
 
-// AddOrder adds a new order for a user
-func (storage *DBStorage) AddOrder(ctx context.Context, username string, orderNumber string) error {
+// CompletePollJob updates the order to its final status/accrual, credits the
+// balance when applicable, and removes the job row, all in one transaction.
+func (storage *DBStorage) CompletePollJob(ctx context.Context, orderNumber string, status string, accrual *float64) error {
 	tx, err := storage.db.Begin()
 	if err != nil {
 		return fmt.Errorf("can't start transaction: %w", err)
@@ -266,54 +598,152 @@ func (storage *DBStorage) AddOrder(ctx context.Context, username string, orderNu
 		}
 	}()
 
-	// Get user ID
-	var userID string
-	query := "SELECT id FROM users WHERE username = $1"
-	err = tx.QueryRowContext(ctx, query, username).Scan(&userID)
+	var username string
+	username, err = usernameForOrder(ctx, tx, orderNumber)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return apperrors.ErrUserNotFound
-		}
-		return fmt.Errorf("error getting user ID: %w", err)
+		return err
+	}
+
+	updateOrderQuery := "UPDATE orders SET status = $1, accrual = $2, updated_at = NOW() WHERE order_number = $3"
+	if _, err = tx.ExecContext(ctx, updateOrderQuery, status, accrual, orderNumber); err != nil {
+		return fmt.Errorf("error updating order status and accrual: %w", err)
 	}
 
-	// Check if order already exists for any user
-	var existingUserID string
-	checkOrderQuery := "SELECT user_id FROM orders WHERE order_number = $1"
-	err = tx.QueryRowContext(ctx, checkOrderQuery, orderNumber).Scan(&existingUserID)
-	if err == nil {
-		// Order exists, check if it's for the same user
-		if existingUserID == userID {
-			return apperrors.ErrOrderAlreadyExists
+	if status == "PROCESSED" && accrual != nil && *accrual > 0 {
+		if err = creditAccrualPosting(ctx, tx, ledger.AccrualTxID(orderNumber), username, orderNumber, *accrual); err != nil {
+			return err
 		}
-		// Order exists for different user
-		return apperrors.ErrOrderOwnedByAnotherUser
-	} else if err != sql.ErrNoRows {
-		return fmt.Errorf("error checking order existence: %w", err)
 	}
 
-	// Insert order
-	insertQuery := "INSERT INTO orders (order_number, user_id, status, uploaded_at) VALUES ($1, $2, 'NEW', NOW())"
-	_, err = tx.ExecContext(ctx, insertQuery, orderNumber, userID)
-	if err != nil {
-		return fmt.Errorf("error inserting order: %w", err)
+	deleteJobQuery := "DELETE FROM accrual_poll_jobs WHERE order_number = $1"
+	if _, err = tx.ExecContext(ctx, deleteJobQuery, orderNumber); err != nil {
+		return fmt.Errorf("error deleting poll job: %w", err)
 	}
 
 	return nil
 }
 
-// UpdateOrderStatus updates the status of an order
-func (storage *DBStorage) UpdateOrderStatus(ctx context.Context, orderNumber string, status string) error {
-	query := "UPDATE orders SET status = $1, updated_at = NOW() WHERE order_number = $2"
-	_, err := storage.db.ExecContext(ctx, query, status, orderNumber)
+// CompletePollJobsBatch is CompletePollJob for many orders at once: a single
+// CASE WHEN UPDATE applies every order's status/accrual, ledger credits are
+// posted per PROCESSED order, and a single DELETE clears all their poll job
+// rows, all in one transaction. This lets the accrual worker drain a round
+// of polled results in one DB round-trip instead of one per order.
+func (storage *DBStorage) CompletePollJobsBatch(ctx context.Context, results []model.AccrualResponse) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		var statusCase, accrualCase, inClause strings.Builder
+		statusCase.WriteString("CASE order_number ")
+		accrualCase.WriteString("CASE order_number ")
+		inClause.WriteString("(")
+
+		args := make([]interface{}, 0, len(results)*3)
+		for i, result := range results {
+			orderPlaceholder := i*3 + 1
+			statusPlaceholder := i*3 + 2
+			accrualPlaceholder := i*3 + 3
+
+			fmt.Fprintf(&statusCase, "WHEN $%d THEN $%d::text ", orderPlaceholder, statusPlaceholder)
+			fmt.Fprintf(&accrualCase, "WHEN $%d THEN $%d::double precision ", orderPlaceholder, accrualPlaceholder)
+			if i > 0 {
+				inClause.WriteString(", ")
+			}
+			fmt.Fprintf(&inClause, "$%d", orderPlaceholder)
+
+			args = append(args, result.Order, result.Status, result.Accrual)
+		}
+		statusCase.WriteString("END")
+		accrualCase.WriteString("END")
+		inClause.WriteString(")")
+
+		updateOrdersQuery := fmt.Sprintf(
+			"UPDATE orders SET status = %s, accrual = %s, updated_at = NOW() WHERE order_number IN %s",
+			statusCase.String(), accrualCase.String(), inClause.String(),
+		)
+		if _, err := tx.ExecContext(ctx, updateOrdersQuery, args...); err != nil {
+			return fmt.Errorf("error batch-updating order status and accrual: %w", err)
+		}
+
+		orderArgs := make([]interface{}, len(results))
+		var orderInClause strings.Builder
+		orderInClause.WriteString("(")
+		for i, result := range results {
+			orderArgs[i] = result.Order
+			if i > 0 {
+				orderInClause.WriteString(", ")
+			}
+			fmt.Fprintf(&orderInClause, "$%d", i+1)
+		}
+		orderInClause.WriteString(")")
+
+		getUsersQuery := fmt.Sprintf(`
+			SELECT o.order_number, u.username FROM orders o
+			INNER JOIN users u ON o.user_id = u.id
+			WHERE o.order_number IN %s
+		`, orderInClause.String())
+		rows, err := tx.QueryContext(ctx, getUsersQuery, orderArgs...)
+		if err != nil {
+			return fmt.Errorf("error getting users for orders: %w", err)
+		}
+		usernames := make(map[string]string, len(results))
+		for rows.Next() {
+			var orderNumber, username string
+			if err := rows.Scan(&orderNumber, &username); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning order owner: %w", err)
+			}
+			usernames[orderNumber] = username
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading order owners: %w", err)
+		}
+		rows.Close()
+
+		for _, result := range results {
+			if result.Status != "PROCESSED" || result.Accrual == nil || *result.Accrual <= 0 {
+				continue
+			}
+			username, ok := usernames[result.Order]
+			if !ok {
+				// The order vanished between ClaimDuePollJobs and here; skip
+				// crediting it rather than failing the whole batch and
+				// leaving every other claimed job stuck.
+				continue
+			}
+			if err := creditAccrualPosting(ctx, tx, ledger.AccrualTxID(result.Order), username, result.Order, *result.Accrual); err != nil {
+				return err
+			}
+		}
+
+		deleteJobsQuery := fmt.Sprintf("DELETE FROM accrual_poll_jobs WHERE order_number IN %s", orderInClause.String())
+		if _, err := tx.ExecContext(ctx, deleteJobsQuery, orderArgs...); err != nil {
+			return fmt.Errorf("error deleting poll jobs: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// ReschedulePollJob bumps attempts and pushes next_attempt_at out so the job
+// is picked up again by ClaimDuePollJobs once it is due.
+func (storage *DBStorage) ReschedulePollJob(ctx context.Context, orderNumber string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE accrual_poll_jobs
+		SET attempts = attempts + 1, next_attempt_at = $1, state = 'PENDING'
+		WHERE order_number = $2
+	`
+	_, err := storage.db.ExecContext(ctx, query, nextAttemptAt, orderNumber)
 	if err != nil {
-		return fmt.Errorf("error updating order status: %w", err)
+		return fmt.Errorf("error rescheduling poll job: %w", err)
 	}
 	return nil
 }
 
-// UpdateOrderStatusAndAccrual updates the status and accrual of an order
-func (storage *DBStorage) UpdateOrderStatusAndAccrual(ctx context.Context, orderNumber string, status string, accrual *float64) error {
+// RegisterCredential binds a newly-enrolled WebAuthn credential to username.
+func (storage *DBStorage) RegisterCredential(ctx context.Context, username string, cred model.WebAuthnCredential) error {
 	tx, err := storage.db.Begin()
 	if err != nil {
 		return fmt.Errorf("can't start transaction: %w", err)
@@ -326,53 +756,401 @@ func (storage *DBStorage) UpdateOrderStatusAndAccrual(ctx context.Context, order
 		}
 	}()
 
-	// Get user ID for the order
 	var userID string
-	getUserQuery := "SELECT user_id FROM orders WHERE order_number = $1"
-	err = tx.QueryRowContext(ctx, getUserQuery, orderNumber).Scan(&userID)
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", username).Scan(&userID)
 	if err != nil {
-		return fmt.Errorf("error getting user ID for order: %w", err)
+		if err == sql.ErrNoRows {
+			return apperrors.ErrUserNotFound
+		}
+		return fmt.Errorf("error getting user ID: %w", err)
 	}
 
-	// Update order status and accrual
-	updateOrderQuery := "UPDATE orders SET status = $1, accrual = $2, updated_at = NOW() WHERE order_number = $3"
-	_, err = tx.ExecContext(ctx, updateOrderQuery, status, accrual, orderNumber)
+	transports, err := json.Marshal(cred.Transports)
 	if err != nil {
-		return fmt.Errorf("error updating order status and accrual: %w", err)
+		return fmt.Errorf("error marshaling credential transports: %w", err)
 	}
 
-	// If order is processed with accrual, update user balance and create transaction
-	if status == "PROCESSED" && accrual != nil && *accrual > 0 {
-		// Update user balance
-		updateBalanceQuery := `
-			UPDATE user_balance 
-			SET balance = balance + $1, updated_at = NOW() 
-			WHERE user_id = $2
+	insertQuery := `
+		INSERT INTO webauthn_credentials (credential_id, user_id, public_key, sign_count, aaguid, transports, attestation_json, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+	`
+	_, err = tx.ExecContext(ctx, insertQuery, cred.CredentialID, userID, cred.PublicKey, cred.SignCount, cred.AAGUID, transports, cred.AttestationJSON)
+	if err != nil {
+		return fmt.Errorf("error saving webauthn credential: %w", err)
+	}
+
+	return nil
+}
+
+// GetCredentialsByUser returns the WebAuthn credentials bound to username.
+func (storage *DBStorage) GetCredentialsByUser(ctx context.Context, username string) ([]model.WebAuthnCredential, error) {
+	var credentials []model.WebAuthnCredential
+	query := `
+		SELECT c.credential_id, c.public_key, c.sign_count, c.aaguid, c.transports, c.attestation_json
+		FROM webauthn_credentials c
+		INNER JOIN users u ON c.user_id = u.id
+		WHERE u.username = $1
+	`
+	rows, err := storage.db.QueryContext(ctx, query, username)
+	if err != nil {
+		return credentials, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cred model.WebAuthnCredential
+		var transports []byte
+		if err := rows.Scan(&cred.CredentialID, &cred.PublicKey, &cred.SignCount, &cred.AAGUID, &transports, &cred.AttestationJSON); err != nil {
+			return credentials, fmt.Errorf("error scanning row: %w", err)
+		}
+		if err := json.Unmarshal(transports, &cred.Transports); err != nil {
+			return credentials, fmt.Errorf("error unmarshaling credential transports: %w", err)
+		}
+		credentials = append(credentials, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return credentials, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return credentials, nil
+}
+
+// UpdateCredentialCounter persists the authenticator's signature counter
+// after a successful assertion.
+func (storage *DBStorage) UpdateCredentialCounter(ctx context.Context, credentialID []byte, signCount uint32) error {
+	query := "UPDATE webauthn_credentials SET sign_count = $1 WHERE credential_id = $2"
+	_, err := storage.db.ExecContext(ctx, query, signCount, credentialID)
+	if err != nil {
+		return fmt.Errorf("error updating credential counter: %w", err)
+	}
+	return nil
+}
+
+// SaveWebAuthnSession stashes in-flight ceremony session data for sessionID,
+// upserting so a retried begin step simply replaces the prior challenge.
+func (storage *DBStorage) SaveWebAuthnSession(ctx context.Context, sessionID string, data []byte) error {
+	query := `
+		INSERT INTO webauthn_sessions (session_id, data, created_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (session_id) DO UPDATE SET data = EXCLUDED.data, created_at = NOW()
+	`
+	_, err := storage.db.ExecContext(ctx, query, sessionID, data)
+	if err != nil {
+		return fmt.Errorf("error saving webauthn session: %w", err)
+	}
+	return nil
+}
+
+// GetWebAuthnSession retrieves session data saved by SaveWebAuthnSession.
+func (storage *DBStorage) GetWebAuthnSession(ctx context.Context, sessionID string) ([]byte, error) {
+	var data []byte
+	query := "SELECT data FROM webauthn_sessions WHERE session_id = $1"
+	err := storage.db.QueryRowContext(ctx, query, sessionID).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, apperrors.ErrWebAuthnSessionNotFound
+		}
+		return nil, fmt.Errorf("error retrieving webauthn session: %w", err)
+	}
+	return data, nil
+}
+
+// DeleteWebAuthnSession removes session data once a ceremony finishes.
+func (storage *DBStorage) DeleteWebAuthnSession(ctx context.Context, sessionID string) error {
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM webauthn_sessions WHERE session_id = $1", sessionID)
+	if err != nil {
+		return fmt.Errorf("error deleting webauthn session: %w", err)
+	}
+	return nil
+}
+
+// LinkOrCreateFederatedUser resolves provider+subject to a username,
+// provisioning an account the first time an identity is seen. It runs inside
+// a retried serializable transaction (withTxRetry, as SetUser, AddOrder and
+// SpendPoints do), so a race between two requests for a brand-new identity
+// can't create two users for it.
+func (storage *DBStorage) LinkOrCreateFederatedUser(ctx context.Context, provider string, subject string, email string) (string, error) {
+	var username string
+	err := storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		lookupQuery := `
+			SELECT u.username FROM federated_identities f
+			INNER JOIN users u ON f.user_id = u.id
+			WHERE f.provider = $1 AND f.subject = $2
 		`
-		_, err = tx.ExecContext(ctx, updateBalanceQuery, *accrual, userID)
-		if err != nil {
-			return fmt.Errorf("error updating user balance: %w", err)
+		err := tx.QueryRowContext(ctx, lookupQuery, provider, subject).Scan(&username)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error looking up federated identity: %w", err)
+		}
+
+		var userID string
+		if email != "" {
+			emailQuery := `
+				SELECT u.id, u.username FROM federated_identities f
+				INNER JOIN users u ON f.user_id = u.id
+				WHERE f.email = $1
+				LIMIT 1
+			`
+			err = tx.QueryRowContext(ctx, emailQuery, email).Scan(&userID, &username)
+		} else {
+			err = sql.ErrNoRows
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			username = federatedUsername(provider, subject)
+			insertUserQuery := "INSERT INTO users (username, password_hash, created_at, updated_at) VALUES ($1, $2, NOW(), NOW()) RETURNING id"
+			if err := tx.QueryRowContext(ctx, insertUserQuery, username, "").Scan(&userID); err != nil {
+				return fmt.Errorf("error creating federated user: %w", err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("error looking up federated identity by email: %w", err)
 		}
 
-		// Create loyalty transaction record for earned points
-		insertTransactionQuery := `
-			INSERT INTO loyalty_transactions (user_id, order_number, points, transaction_type, processed_at)
-			VALUES ($1, $2, $3, 'earn', NOW())
+		insertIdentityQuery := `
+			INSERT INTO federated_identities (user_id, provider, subject, email, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
 		`
-		_, err = tx.ExecContext(ctx, insertTransactionQuery, userID, orderNumber, *accrual)
+		if _, err := tx.ExecContext(ctx, insertIdentityQuery, userID, provider, subject, email); err != nil {
+			return fmt.Errorf("error saving federated identity: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// LinkFederatedIdentityToUser attaches provider+subject to an already
+// authenticated user, so an existing password (or passkey) account can add a
+// social login directly instead of relying on LinkOrCreateFederatedUser's
+// unauthenticated email match, which never fires for an account that has
+// never linked a provider before.
+func (storage *DBStorage) LinkFederatedIdentityToUser(ctx context.Context, username string, provider string, subject string, email string) error {
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		var userID string
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", username).Scan(&userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return apperrors.ErrUserNotFound
+			}
+			return fmt.Errorf("error looking up user: %w", err)
+		}
+
+		var existingUserID string
+		lookupQuery := `SELECT user_id FROM federated_identities WHERE provider = $1 AND subject = $2`
+		err := tx.QueryRowContext(ctx, lookupQuery, provider, subject).Scan(&existingUserID)
+		if err == nil {
+			if existingUserID != userID {
+				return apperrors.ErrFederatedIdentityLinked
+			}
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error looking up federated identity: %w", err)
+		}
+
+		insertIdentityQuery := `
+			INSERT INTO federated_identities (user_id, provider, subject, email, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+		`
+		if _, err := tx.ExecContext(ctx, insertIdentityQuery, userID, provider, subject, email); err != nil {
+			return fmt.Errorf("error saving federated identity: %w", err)
+		}
+		return nil
+	})
+}
+
+// federatedUsername derives a stable, collision-free username for a
+// federated-only account: provider identities are already unique per
+// provider, so "<provider>:<subject>" can't collide with another federated
+// account or a password-registered one picking an ordinary name.
+func federatedUsername(provider string, subject string) string {
+	return provider + ":" + subject
+}
+
+// CreateRefreshSession persists a newly-issued refresh token, hashed by the
+// caller, alongside the access-token jti it was issued with.
+func (storage *DBStorage) CreateRefreshSession(ctx context.Context, session model.RefreshSession) error {
+	return storage.withTxRetry(ctx, func(tx *sql.Tx) error {
+		var userID string
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", session.Username).Scan(&userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return apperrors.ErrUserNotFound
+			}
+			return fmt.Errorf("error getting user ID: %w", err)
+		}
+
+		insertQuery := `
+			INSERT INTO refresh_tokens (user_id, token_hash, access_jti, issued_at, expires_at, user_agent, ip)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+		_, err := tx.ExecContext(ctx, insertQuery, userID, session.TokenHash, session.AccessJTI, session.IssuedAt, session.ExpiresAt, session.UserAgent, session.IP)
 		if err != nil {
-			return fmt.Errorf("error creating loyalty transaction: %w", err)
+			return fmt.Errorf("error saving refresh session: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetRefreshSessionByHash looks up a refresh session by its token hash,
+// revoked or not.
+func (storage *DBStorage) GetRefreshSessionByHash(ctx context.Context, tokenHash string) (model.RefreshSession, error) {
+	query := `
+		SELECT u.username, r.token_hash, r.access_jti, r.issued_at, r.expires_at, r.revoked_at, r.user_agent, r.ip
+		FROM refresh_tokens r
+		INNER JOIN users u ON r.user_id = u.id
+		WHERE r.token_hash = $1
+	`
+	var session model.RefreshSession
+	var userAgent, ip sql.NullString
+	err := storage.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&session.Username, &session.TokenHash, &session.AccessJTI, &session.IssuedAt, &session.ExpiresAt, &session.RevokedAt, &userAgent, &ip,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.RefreshSession{}, apperrors.ErrRefreshTokenNotFound
 		}
+		return model.RefreshSession{}, fmt.Errorf("error retrieving refresh session: %w", err)
 	}
+	session.UserAgent = userAgent.String
+	session.IP = ip.String
+	return session, nil
+}
 
+// RevokeRefreshSession marks the session for tokenHash as revoked, if found
+// and not already revoked.
+func (storage *DBStorage) RevokeRefreshSession(ctx context.Context, tokenHash string) error {
+	query := "UPDATE refresh_tokens SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL"
+	result, err := storage.db.ExecContext(ctx, query, tokenHash)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh session: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return apperrors.ErrRefreshTokenNotFound
+	}
 	return nil
 }
 
+// DeleteRefreshSessionByHash removes the session for tokenHash outright,
+// leaving no revoked tombstone behind - a missing hash is not an error.
+func (storage *DBStorage) DeleteRefreshSessionByHash(ctx context.Context, tokenHash string) error {
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return fmt.Errorf("error deleting refresh session: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshSessionByJTI removes the refresh session issued alongside
+// access-token jti, scoped to username.
+func (storage *DBStorage) RevokeRefreshSessionByJTI(ctx context.Context, username string, jti string) error {
+	query := `
+		DELETE FROM refresh_tokens
+		WHERE access_jti = $1 AND revoked_at IS NULL
+		AND user_id = (SELECT id FROM users WHERE username = $2)
+	`
+	result, err := storage.db.ExecContext(ctx, query, jti, username)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh session: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return apperrors.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+// RevokeAllRefreshSessions revokes every refresh session belonging to
+// username, used to tear down every active session on a detected replay.
+func (storage *DBStorage) RevokeAllRefreshSessions(ctx context.Context, username string) error {
+	query := `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE revoked_at IS NULL AND user_id = (SELECT id FROM users WHERE username = $1)
+	`
+	_, err := storage.db.ExecContext(ctx, query, username)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh sessions: %w", err)
+	}
+	return nil
+}
+
+// ListActiveRefreshSessions returns username's not-yet-revoked, not-yet-expired
+// refresh sessions.
+func (storage *DBStorage) ListActiveRefreshSessions(ctx context.Context, username string) ([]model.RefreshSession, error) {
+	query := `
+		SELECT r.access_jti, r.issued_at, r.expires_at, r.user_agent, r.ip
+		FROM refresh_tokens r
+		INNER JOIN users u ON r.user_id = u.id
+		WHERE u.username = $1 AND r.revoked_at IS NULL AND r.expires_at > NOW()
+		ORDER BY r.issued_at DESC
+	`
+	rows, err := storage.db.QueryContext(ctx, query, username)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []model.RefreshSession
+	for rows.Next() {
+		session := model.RefreshSession{Username: username}
+		var userAgent, ip sql.NullString
+		if err := rows.Scan(&session.AccessJTI, &session.IssuedAt, &session.ExpiresAt, &userAgent, &ip); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		session.UserAgent = userAgent.String
+		session.IP = ip.String
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return sessions, nil
+}
+
+// RevokeAccessJTI denylists jti until expiresAt.
+func (storage *DBStorage) RevokeAccessJTI(ctx context.Context, jti string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_access_jti (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	_, err := storage.db.ExecContext(ctx, query, jti, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error revoking access token: %w", err)
+	}
+	return nil
+}
+
+// IsAccessJTIRevoked reports whether jti has been denylisted by
+// RevokeAccessJTI.
+func (storage *DBStorage) IsAccessJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM revoked_access_jti WHERE jti = $1)"
+	err := storage.db.QueryRowContext(ctx, query, jti).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking if access token is revoked: %w", err)
+	}
+	return exists, nil
+}
+
 // Ping checks if the database connection is alive
 func (storage *DBStorage) Ping(ctx context.Context) error {
 	return storage.db.PingContext(ctx)
 }
 
+// ProbeWrite inserts then deletes a throwaway row in health_probes, so a
+// read-only or otherwise degraded database - which would still answer Ping
+// - shows up as unhealthy.
+func (storage *DBStorage) ProbeWrite(ctx context.Context) error {
+	id := uuid.NewString()
+	if _, err := storage.db.ExecContext(ctx, "INSERT INTO health_probes (id, created_at) VALUES ($1, NOW())", id); err != nil {
+		return fmt.Errorf("error writing health probe: %w", err)
+	}
+	if _, err := storage.db.ExecContext(ctx, "DELETE FROM health_probes WHERE id = $1", id); err != nil {
+		return fmt.Errorf("error deleting health probe: %w", err)
+	}
+	return nil
+}
+
 // Check if user has already existed
 func (storage *DBStorage) checkUserExists(ctx context.Context, tx *sql.Tx, username string) (bool, error) {
 	var exists bool
@@ -0,0 +1,739 @@
+// Package memstore is an in-memory repository.Repository implementation
+// intended for unit tests and local demos (SystemConfig.StorageBackend ==
+// "memory"). It guards each aggregate (users, orders/poll jobs, ledger) with
+// its own RWMutex rather than one global lock, matching how DBStorage scopes
+// its transactions per aggregate.
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/auth"
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/google/uuid"
+)
+
+type userRecord struct {
+	passwordHash string
+}
+
+type orderRecord struct {
+	username   string
+	status     string
+	accrual    *float64
+	uploadedAt time.Time
+}
+
+type pollJobRecord struct {
+	nextAttemptAt time.Time
+	attempts      int
+	state         string
+}
+
+// Store is an in-memory Repository. The zero value is not usable; construct
+// one with New.
+type Store struct {
+	usersMu sync.RWMutex
+	users   map[string]userRecord
+
+	ordersMu sync.RWMutex
+	orders   map[string]*orderRecord
+	pollJobs map[string]*pollJobRecord
+
+	ledgerMu         sync.RWMutex
+	postings         map[string][]ledger.Posting
+	transactions     []ledger.Transaction
+	transactionTimes map[string]time.Time
+
+	credentialsMu sync.RWMutex
+	credentials   map[string][]model.WebAuthnCredential
+
+	sessionsMu sync.RWMutex
+	sessions   map[string][]byte
+
+	federatedMu      sync.RWMutex
+	federatedByKey   map[string]string // "<provider>:<subject>" -> username
+	federatedByEmail map[string]string // email -> username, first identity seen wins
+
+	refreshMu       sync.RWMutex
+	refreshSessions map[string]*model.RefreshSession // token hash -> session
+
+	revokedJTIMu sync.RWMutex
+	revokedJTI   map[string]time.Time // jti -> expiresAt
+
+	healthProbesMu sync.Mutex
+	healthProbes   map[string]time.Time // probe id -> written-at, always empty outside ProbeWrite
+}
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{
+		users:            make(map[string]userRecord),
+		orders:           make(map[string]*orderRecord),
+		pollJobs:         make(map[string]*pollJobRecord),
+		postings:         make(map[string][]ledger.Posting),
+		transactionTimes: make(map[string]time.Time),
+		credentials:      make(map[string][]model.WebAuthnCredential),
+		sessions:         make(map[string][]byte),
+		federatedByKey:   make(map[string]string),
+		federatedByEmail: make(map[string]string),
+		refreshSessions:  make(map[string]*model.RefreshSession),
+		revokedJTI:       make(map[string]time.Time),
+		healthProbes:     make(map[string]time.Time),
+	}
+}
+
+func (s *Store) SetUser(_ context.Context, user model.User) error {
+	if user.Username == "" || user.Password == "" {
+		return apperrors.ErrInvalidRequest
+	}
+
+	passwordHash, err := auth.HashPassword(user.Password)
+	if err != nil {
+		return apperrors.ErrPasswordHashing
+	}
+
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+
+	if _, exists := s.users[user.Username]; exists {
+		return apperrors.ErrUserAlreadyExists
+	}
+	s.users[user.Username] = userRecord{passwordHash: passwordHash}
+	return nil
+}
+
+func (s *Store) CheckUser(_ context.Context, user model.User) (bool, error) {
+	if user.Username == "" || user.Password == "" {
+		return false, apperrors.ErrInvalidCredentials
+	}
+
+	s.usersMu.RLock()
+	record, exists := s.users[user.Username]
+	s.usersMu.RUnlock()
+	if !exists {
+		return false, apperrors.ErrUserNotFound
+	}
+
+	if err := auth.CheckPassword(user.Password, record.passwordHash); err != nil {
+		return false, apperrors.ErrInvalidPassword
+	}
+	return true, nil
+}
+
+func (s *Store) UserExists(_ context.Context, username string) (bool, error) {
+	return s.userExists(username), nil
+}
+
+func (s *Store) userExists(username string) bool {
+	s.usersMu.RLock()
+	defer s.usersMu.RUnlock()
+	_, exists := s.users[username]
+	return exists
+}
+
+// AddOrder registers orderNumber for username, distinguishing an order the
+// same user already submitted from one owned by someone else.
+func (s *Store) AddOrder(_ context.Context, username string, orderNumber string) error {
+	if !s.userExists(username) {
+		return apperrors.ErrUserNotFound
+	}
+
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+
+	if existing, exists := s.orders[orderNumber]; exists {
+		if existing.username == username {
+			return apperrors.ErrOrderAlreadyExists
+		}
+		return apperrors.ErrOrderOwnedByAnotherUser
+	}
+
+	s.orders[orderNumber] = &orderRecord{
+		username:   username,
+		status:     "NEW",
+		uploadedAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *Store) UpdateOrderStatus(_ context.Context, orderNumber string, status string) error {
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+
+	if order, exists := s.orders[orderNumber]; exists {
+		order.status = status
+	}
+	return nil
+}
+
+func (s *Store) UpdateOrderStatusAndAccrual(_ context.Context, orderNumber string, status string, accrualValue *float64) error {
+	s.ordersMu.Lock()
+	order, exists := s.orders[orderNumber]
+	if !exists {
+		s.ordersMu.Unlock()
+		return nil
+	}
+	order.status = status
+	order.accrual = accrualValue
+	username := order.username
+	s.ordersMu.Unlock()
+
+	if status == "PROCESSED" && accrualValue != nil && *accrualValue > 0 {
+		s.creditAccrual(ledger.AccrualTxID(orderNumber), username, orderNumber, *accrualValue)
+	}
+	return nil
+}
+
+// creditAccrual posts an accrual credit transaction keyed by txid, so
+// calling it twice for the same key (e.g. a retried status update) can't
+// double-credit the order.
+func (s *Store) creditAccrual(txid string, username string, orderNumber string, amount float64) {
+	txn := ledger.NewAccrualTransaction(txid, username, orderNumber, amount)
+	s.postTransaction(txn)
+}
+
+func (s *Store) GetOrders(_ context.Context, username string) ([]model.Order, error) {
+	s.ordersMu.RLock()
+	defer s.ordersMu.RUnlock()
+
+	var orders []model.Order
+	for number, order := range s.orders {
+		if order.username != username {
+			continue
+		}
+		orders = append(orders, model.Order{
+			Number:     number,
+			Status:     order.status,
+			Accrual:    order.accrual,
+			UploadedAt: order.uploadedAt,
+		})
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].UploadedAt.After(orders[j].UploadedAt) })
+	return orders, nil
+}
+
+// GetUserBalance sums the postings against the user's available and spent
+// accounts, mirroring DBStorage's derivation from the ledger rather than a
+// stored scalar.
+func (s *Store) GetUserBalance(_ context.Context, username string) (model.UserBalance, error) {
+	if !s.userExists(username) {
+		return model.UserBalance{}, apperrors.ErrBalanceNotFound
+	}
+
+	s.ledgerMu.RLock()
+	defer s.ledgerMu.RUnlock()
+
+	return model.UserBalance{
+		Balance:    s.sumAccountLocked(ledger.AvailableAccount(username)),
+		TotalSpent: s.sumAccountLocked(ledger.SpentAccount(username)),
+	}, nil
+}
+
+func (s *Store) GetWithdrawals(_ context.Context, username string) ([]model.Withdrawal, error) {
+	account := ledger.SpentAccount(username)
+
+	s.ledgerMu.RLock()
+	defer s.ledgerMu.RUnlock()
+
+	var withdrawals []model.Withdrawal
+	for _, txn := range s.transactions {
+		if txn.Kind != ledger.KindWithdrawal {
+			continue
+		}
+		for _, posting := range txn.Postings {
+			if posting.Account != account {
+				continue
+			}
+			withdrawals = append(withdrawals, model.Withdrawal{
+				Order:       txn.Order,
+				Sum:         posting.Amount,
+				ProcessedAt: s.transactionTimes[txn.TxID],
+			})
+		}
+	}
+	sort.Slice(withdrawals, func(i, j int) bool { return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt) })
+	return withdrawals, nil
+}
+
+// SpendPoints atomically checks the user's available balance covers the
+// withdrawal and, if so, posts the debiting transaction, all under a single
+// ledger lock so a concurrent spend can't overdraw the account.
+func (s *Store) SpendPoints(_ context.Context, orderWithdrawal model.OrderWithdrawal) error {
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
+
+	if !s.userExists(username) {
+		return apperrors.ErrBalanceNotFound
+	}
+
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+
+	if orderWithdrawal.Sum > s.sumAccountLocked(ledger.AvailableAccount(username)) {
+		return apperrors.ErrInsufficientFunds
+	}
+
+	txn := ledger.NewWithdrawalTransaction(uuid.NewString(), username, orderWithdrawal.Order, orderWithdrawal.Sum)
+	s.postTransactionLocked(txn)
+	return nil
+}
+
+// SpendPointsIdempotent is SpendPoints keyed by an idempotency key: a
+// retried request with the same key finds its transaction already posted
+// and returns success without re-checking or re-debiting the balance.
+func (s *Store) SpendPointsIdempotent(_ context.Context, key string, orderWithdrawal model.OrderWithdrawal) error {
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
+
+	if !s.userExists(username) {
+		return apperrors.ErrBalanceNotFound
+	}
+
+	txid := ledger.WithdrawalTxID(key)
+
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+
+	if _, exists := s.transactionTimes[txid]; exists {
+		return nil
+	}
+
+	if orderWithdrawal.Sum > s.sumAccountLocked(ledger.AvailableAccount(username)) {
+		return apperrors.ErrInsufficientFunds
+	}
+
+	txn := ledger.NewWithdrawalTransaction(txid, username, orderWithdrawal.Order, orderWithdrawal.Sum)
+	s.postTransactionLocked(txn)
+	return nil
+}
+
+// CreditAccrualIdempotent is the credit half of UpdateOrderStatusAndAccrual,
+// exposed directly so the accrual poller can retry crediting a PROCESSED
+// order without going through a full status update, and without
+// double-crediting on retry.
+func (s *Store) CreditAccrualIdempotent(_ context.Context, key string, orderNumber string, amount float64) error {
+	s.ordersMu.RLock()
+	order, exists := s.orders[orderNumber]
+	s.ordersMu.RUnlock()
+	if !exists {
+		return fmt.Errorf("error getting user for order %q: no such order", orderNumber)
+	}
+
+	s.creditAccrual(ledger.AccrualTxID(key), order.username, orderNumber, amount)
+	return nil
+}
+
+// RecomputeBalance re-derives a user's balance straight from the ledger.
+// GetUserBalance already computes it this way on every call instead of from
+// a cache, so this is the same query exposed as its own entrypoint for
+// reconciliation tooling to assert the two agree.
+func (s *Store) RecomputeBalance(ctx context.Context, username string) (model.UserBalance, error) {
+	return s.GetUserBalance(ctx, username)
+}
+
+func (s *Store) PostTransaction(_ context.Context, transaction ledger.Transaction) error {
+	s.postTransaction(transaction)
+	return nil
+}
+
+func (s *Store) postTransaction(transaction ledger.Transaction) {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	s.postTransactionLocked(transaction)
+}
+
+// postTransactionLocked appends transaction's postings unless its TxID has
+// already been posted, giving callers that derive TxID deterministically
+// (ledger.AccrualTxID, ledger.WithdrawalTxID) idempotent posting for free.
+func (s *Store) postTransactionLocked(transaction ledger.Transaction) {
+	if _, exists := s.transactionTimes[transaction.TxID]; exists {
+		return
+	}
+	s.transactionTimes[transaction.TxID] = time.Now()
+	s.transactions = append(s.transactions, transaction)
+	for _, posting := range transaction.Postings {
+		s.postings[posting.Account] = append(s.postings[posting.Account], posting)
+	}
+}
+
+func (s *Store) sumAccountLocked(account string) float64 {
+	var total float64
+	for _, posting := range s.postings[account] {
+		total += posting.Amount
+	}
+	return total
+}
+
+// EnqueuePollJob schedules an accrual-poll job for orderNumber, due immediately.
+func (s *Store) EnqueuePollJob(_ context.Context, orderNumber string) error {
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+
+	if _, exists := s.pollJobs[orderNumber]; exists {
+		return nil
+	}
+	s.pollJobs[orderNumber] = &pollJobRecord{nextAttemptAt: time.Now(), state: "PENDING"}
+	return nil
+}
+
+// ClaimDuePollJobs claims up to limit due jobs. A single RWMutex-guarded map
+// makes the claim atomic without needing SELECT ... FOR UPDATE SKIP LOCKED.
+func (s *Store) ClaimDuePollJobs(_ context.Context, limit int) ([]model.PollJob, error) {
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+
+	var due []string
+	for orderNumber, job := range s.pollJobs {
+		if job.state == "PENDING" && !job.nextAttemptAt.After(time.Now()) {
+			due = append(due, orderNumber)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return s.pollJobs[due[i]].nextAttemptAt.Before(s.pollJobs[due[j]].nextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := make([]model.PollJob, 0, len(due))
+	for _, orderNumber := range due {
+		job := s.pollJobs[orderNumber]
+		job.state = "CLAIMED"
+		jobs = append(jobs, model.PollJob{
+			OrderNumber:   orderNumber,
+			NextAttemptAt: job.nextAttemptAt,
+			Attempts:      job.attempts,
+			State:         job.state,
+		})
+	}
+	return jobs, nil
+}
+
+// CompletePollJob records the order's final status/accrual and removes its
+// job row.
+func (s *Store) CompletePollJob(ctx context.Context, orderNumber string, status string, accrualValue *float64) error {
+	if err := s.UpdateOrderStatusAndAccrual(ctx, orderNumber, status, accrualValue); err != nil {
+		return err
+	}
+
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+	delete(s.pollJobs, orderNumber)
+	return nil
+}
+
+// CompletePollJobsBatch is CompletePollJob for many orders at once. There is
+// no per-call transaction overhead to save in-process, so it is just a loop
+// over CompletePollJob rather than one atomic operation like the DB-backed
+// stores: it exists so the accrual worker can call one repository method
+// regardless of backend, not for its own performance.
+func (s *Store) CompletePollJobsBatch(ctx context.Context, results []model.AccrualResponse) error {
+	for _, result := range results {
+		if err := s.CompletePollJob(ctx, result.Order, result.Status, result.Accrual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReschedulePollJob bumps attempts and pushes next_attempt_at out so the job
+// is picked up again by ClaimDuePollJobs once it is due.
+func (s *Store) ReschedulePollJob(_ context.Context, orderNumber string, nextAttemptAt time.Time) error {
+	s.ordersMu.Lock()
+	defer s.ordersMu.Unlock()
+
+	job, exists := s.pollJobs[orderNumber]
+	if !exists {
+		return nil
+	}
+	job.attempts++
+	job.nextAttemptAt = nextAttemptAt
+	job.state = "PENDING"
+	return nil
+}
+
+// RegisterCredential binds a newly-enrolled WebAuthn credential to username.
+func (s *Store) RegisterCredential(_ context.Context, username string, cred model.WebAuthnCredential) error {
+	if !s.userExists(username) {
+		return apperrors.ErrUserNotFound
+	}
+
+	s.credentialsMu.Lock()
+	defer s.credentialsMu.Unlock()
+	s.credentials[username] = append(s.credentials[username], cred)
+	return nil
+}
+
+// GetCredentialsByUser returns the WebAuthn credentials bound to username.
+func (s *Store) GetCredentialsByUser(_ context.Context, username string) ([]model.WebAuthnCredential, error) {
+	s.credentialsMu.RLock()
+	defer s.credentialsMu.RUnlock()
+	return s.credentials[username], nil
+}
+
+// UpdateCredentialCounter persists the authenticator's signature counter
+// after a successful assertion.
+func (s *Store) UpdateCredentialCounter(_ context.Context, credentialID []byte, signCount uint32) error {
+	s.credentialsMu.Lock()
+	defer s.credentialsMu.Unlock()
+
+	for _, creds := range s.credentials {
+		for i := range creds {
+			if bytes.Equal(creds[i].CredentialID, credentialID) {
+				creds[i].SignCount = signCount
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// SaveWebAuthnSession stashes in-flight ceremony session data for sessionID.
+func (s *Store) SaveWebAuthnSession(_ context.Context, sessionID string, data []byte) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.sessions[sessionID] = data
+	return nil
+}
+
+// GetWebAuthnSession retrieves session data saved by SaveWebAuthnSession.
+func (s *Store) GetWebAuthnSession(_ context.Context, sessionID string) ([]byte, error) {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+
+	data, exists := s.sessions[sessionID]
+	if !exists {
+		return nil, apperrors.ErrWebAuthnSessionNotFound
+	}
+	return data, nil
+}
+
+// DeleteWebAuthnSession removes session data once a ceremony finishes.
+func (s *Store) DeleteWebAuthnSession(_ context.Context, sessionID string) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+// LinkOrCreateFederatedUser resolves provider+subject to a username,
+// provisioning an account the first time an identity is seen. An identity
+// whose email matches one already linked under another provider links to
+// that same account instead of creating a duplicate.
+func (s *Store) LinkOrCreateFederatedUser(_ context.Context, provider string, subject string, email string) (string, error) {
+	key := provider + ":" + subject
+
+	s.federatedMu.Lock()
+	defer s.federatedMu.Unlock()
+
+	if username, ok := s.federatedByKey[key]; ok {
+		return username, nil
+	}
+
+	username, ok := s.federatedByEmail[email]
+	if !ok {
+		username = federatedUsername(provider, subject)
+		s.usersMu.Lock()
+		s.users[username] = userRecord{}
+		s.usersMu.Unlock()
+	}
+
+	s.federatedByKey[key] = username
+	if email != "" {
+		if _, exists := s.federatedByEmail[email]; !exists {
+			s.federatedByEmail[email] = username
+		}
+	}
+	return username, nil
+}
+
+// LinkFederatedIdentityToUser attaches provider+subject to an already
+// authenticated user, so an existing password (or passkey) account can add a
+// social login directly instead of relying on LinkOrCreateFederatedUser's
+// unauthenticated email match, which never fires for an account that has
+// never linked a provider before.
+func (s *Store) LinkFederatedIdentityToUser(_ context.Context, username string, provider string, subject string, email string) error {
+	s.usersMu.RLock()
+	_, exists := s.users[username]
+	s.usersMu.RUnlock()
+	if !exists {
+		return apperrors.ErrUserNotFound
+	}
+
+	key := provider + ":" + subject
+
+	s.federatedMu.Lock()
+	defer s.federatedMu.Unlock()
+
+	if linkedUsername, ok := s.federatedByKey[key]; ok {
+		if linkedUsername != username {
+			return apperrors.ErrFederatedIdentityLinked
+		}
+		return nil
+	}
+
+	s.federatedByKey[key] = username
+	if email != "" {
+		if _, exists := s.federatedByEmail[email]; !exists {
+			s.federatedByEmail[email] = username
+		}
+	}
+	return nil
+}
+
+// federatedUsername derives a stable, collision-free username for a
+// federated-only account: provider identities are already unique per
+// provider, so "<provider>:<subject>" can't collide with another federated
+// account or a password-registered one picking an ordinary name.
+func federatedUsername(provider string, subject string) string {
+	return provider + ":" + subject
+}
+
+// CreateRefreshSession persists a newly-issued refresh token, keyed by its
+// hash so a lookup never has to compare against the raw token.
+func (s *Store) CreateRefreshSession(_ context.Context, session model.RefreshSession) error {
+	record := session
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	s.refreshSessions[session.TokenHash] = &record
+	return nil
+}
+
+// GetRefreshSessionByHash looks up a refresh session by its token hash,
+// revoked or not - the caller decides what a revoked hit means.
+func (s *Store) GetRefreshSessionByHash(_ context.Context, tokenHash string) (model.RefreshSession, error) {
+	s.refreshMu.RLock()
+	defer s.refreshMu.RUnlock()
+
+	record, exists := s.refreshSessions[tokenHash]
+	if !exists {
+		return model.RefreshSession{}, apperrors.ErrRefreshTokenNotFound
+	}
+	return *record, nil
+}
+
+// RevokeRefreshSession marks the session for tokenHash as revoked, if found.
+func (s *Store) RevokeRefreshSession(_ context.Context, tokenHash string) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	record, exists := s.refreshSessions[tokenHash]
+	if !exists || record.RevokedAt != nil {
+		return apperrors.ErrRefreshTokenNotFound
+	}
+	now := time.Now()
+	record.RevokedAt = &now
+	return nil
+}
+
+// DeleteRefreshSessionByHash removes the session for tokenHash outright,
+// leaving no revoked tombstone behind - a missing hash is not an error.
+func (s *Store) DeleteRefreshSessionByHash(_ context.Context, tokenHash string) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	delete(s.refreshSessions, tokenHash)
+	return nil
+}
+
+// RevokeRefreshSessionByJTI removes the refresh session issued alongside
+// access-token jti, scoped to username.
+func (s *Store) RevokeRefreshSessionByJTI(_ context.Context, username string, jti string) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	for hash, record := range s.refreshSessions {
+		if record.Username == username && record.AccessJTI == jti && record.RevokedAt == nil {
+			delete(s.refreshSessions, hash)
+			return nil
+		}
+	}
+	return apperrors.ErrRefreshTokenNotFound
+}
+
+// RevokeAllRefreshSessions revokes every refresh session belonging to
+// username, used to tear down every active session on a detected replay.
+func (s *Store) RevokeAllRefreshSessions(_ context.Context, username string) error {
+	now := time.Now()
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	for _, record := range s.refreshSessions {
+		if record.Username == username && record.RevokedAt == nil {
+			revokedAt := now
+			record.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+// ListActiveRefreshSessions returns username's not-yet-revoked,
+// not-yet-expired refresh sessions.
+func (s *Store) ListActiveRefreshSessions(_ context.Context, username string) ([]model.RefreshSession, error) {
+	now := time.Now()
+	s.refreshMu.RLock()
+	defer s.refreshMu.RUnlock()
+
+	var sessions []model.RefreshSession
+	for _, record := range s.refreshSessions {
+		if record.Username == username && record.RevokedAt == nil && record.ExpiresAt.After(now) {
+			sessions = append(sessions, *record)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].IssuedAt.After(sessions[j].IssuedAt) })
+	return sessions, nil
+}
+
+// RevokeAccessJTI denylists jti until expiresAt.
+func (s *Store) RevokeAccessJTI(_ context.Context, jti string, expiresAt time.Time) error {
+	s.revokedJTIMu.Lock()
+	defer s.revokedJTIMu.Unlock()
+	s.revokedJTI[jti] = expiresAt
+	return nil
+}
+
+// IsAccessJTIRevoked reports whether jti has been denylisted by
+// RevokeAccessJTI.
+func (s *Store) IsAccessJTIRevoked(_ context.Context, jti string) (bool, error) {
+	s.revokedJTIMu.RLock()
+	defer s.revokedJTIMu.RUnlock()
+	_, revoked := s.revokedJTI[jti]
+	return revoked, nil
+}
+
+// Ping always succeeds: there is no network round trip to a process's own
+// memory.
+func (s *Store) Ping(_ context.Context) error {
+	return nil
+}
+
+// ProbeWrite exercises the same write-then-delete round trip the real
+// storage backends do, against a throwaway entry in s.healthProbes, so
+// tests and local demos run through the same code path health.Checker does
+// against postgres/sqlite.
+func (s *Store) ProbeWrite(_ context.Context) error {
+	id := uuid.NewString()
+
+	s.healthProbesMu.Lock()
+	s.healthProbes[id] = time.Now()
+	delete(s.healthProbes, id)
+	s.healthProbesMu.Unlock()
+	return nil
+}
+
+// Close is a no-op; memstore owns no external resources.
+func (s *Store) Close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package memstore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddOrder_DistinguishesOwnership(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	require.NoError(t, store.SetUser(ctx, model.User{Username: "alice", Password: "pw"}))
+	require.NoError(t, store.SetUser(ctx, model.User{Username: "bob", Password: "pw"}))
+
+	require.NoError(t, store.AddOrder(ctx, "alice", "12345678903"))
+
+	err := store.AddOrder(ctx, "alice", "12345678903")
+	assert.ErrorIs(t, err, apperrors.ErrOrderAlreadyExists)
+
+	err = store.AddOrder(ctx, "bob", "12345678903")
+	assert.ErrorIs(t, err, apperrors.ErrOrderOwnedByAnotherUser)
+}
+
+func TestSpendPoints_AtomicCheckAndDebit(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	require.NoError(t, store.SetUser(ctx, model.User{Username: "alice", Password: "pw"}))
+	require.NoError(t, store.AddOrder(ctx, "alice", "12345678903"))
+	require.NoError(t, store.UpdateOrderStatusAndAccrual(ctx, "12345678903", "PROCESSED", floatPtr(100)))
+
+	username := "alice"
+
+	// Fire 10 concurrent withdrawals of 100; the ledger only has 100, so
+	// exactly one must succeed and the rest must see insufficient funds.
+	var wg sync.WaitGroup
+	results := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = store.SpendPoints(ctx, model.OrderWithdrawal{
+				User:  &username,
+				Order: "98765432100",
+				Sum:   100,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	successes := 0
+	for _, err := range results {
+		if err == nil {
+			successes++
+		} else {
+			assert.ErrorIs(t, err, apperrors.ErrInsufficientFunds)
+		}
+	}
+	assert.Equal(t, 1, successes)
+
+	balance, err := store.GetUserBalance(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, balance.Balance)
+	assert.Equal(t, 100.0, balance.TotalSpent)
+}
+
+func TestClaimDuePollJobs_MarksClaimed(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	require.NoError(t, store.EnqueuePollJob(ctx, "12345678903"))
+
+	jobs, err := store.ClaimDuePollJobs(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "CLAIMED", jobs[0].State)
+
+	// Already claimed, so a second claim sees nothing due.
+	jobs, err = store.ClaimDuePollJobs(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func TestLinkOrCreateFederatedUser_LinksByIdentityThenByEmail(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+
+	username, err := store.LinkOrCreateFederatedUser(ctx, "google", "subj-1", "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "google:subj-1", username)
+
+	// Same identity seen again returns the same username instead of
+	// provisioning a second account.
+	again, err := store.LinkOrCreateFederatedUser(ctx, "google", "subj-1", "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, username, again)
+
+	// A different provider's identity sharing the same email links to the
+	// same account rather than creating a duplicate.
+	linked, err := store.LinkOrCreateFederatedUser(ctx, "github", "subj-2", "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, username, linked)
+
+	// No email match at all provisions a brand-new account.
+	other, err := store.LinkOrCreateFederatedUser(ctx, "yandex", "subj-3", "bob@example.com")
+	require.NoError(t, err)
+	assert.NotEqual(t, username, other)
+}
+
+func TestLinkFederatedIdentityToUser(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	require.NoError(t, store.SetUser(ctx, model.User{Username: "alice", Password: "pw"}))
+	require.NoError(t, store.SetUser(ctx, model.User{Username: "bob", Password: "pw"}))
+
+	// A password-registered account can link a provider directly.
+	err := store.LinkFederatedIdentityToUser(ctx, "alice", "google", "subj-1", "alice@example.com")
+	require.NoError(t, err)
+
+	// Linking the same identity to the same account again is a no-op.
+	err = store.LinkFederatedIdentityToUser(ctx, "alice", "google", "subj-1", "alice@example.com")
+	require.NoError(t, err)
+
+	// The same identity can't be linked to a second account.
+	err = store.LinkFederatedIdentityToUser(ctx, "bob", "google", "subj-1", "alice@example.com")
+	assert.ErrorIs(t, err, apperrors.ErrFederatedIdentityLinked)
+
+	// Linking against a username that doesn't exist fails clearly.
+	err = store.LinkFederatedIdentityToUser(ctx, "nobody", "google", "subj-2", "")
+	assert.ErrorIs(t, err, apperrors.ErrUserNotFound)
+}
+
+func TestRevokeRefreshSession_AlreadyRevoked(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	require.NoError(t, store.CreateRefreshSession(ctx, model.RefreshSession{
+		Username:  "alice",
+		TokenHash: "hash-1",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}))
+
+	require.NoError(t, store.RevokeRefreshSession(ctx, "hash-1"))
+
+	// Revoking an already-revoked session reports ErrRefreshTokenNotFound,
+	// matching the DB-backed stores' compare-and-swap UPDATE ... WHERE
+	// revoked_at IS NULL, which affects zero rows the second time.
+	err := store.RevokeRefreshSession(ctx, "hash-1")
+	assert.ErrorIs(t, err, apperrors.ErrRefreshTokenNotFound)
+
+	err = store.RevokeRefreshSession(ctx, "no-such-hash")
+	assert.ErrorIs(t, err, apperrors.ErrRefreshTokenNotFound)
+}
+
+func floatPtr(f float64) *float64 { return &f }
@@ -2,20 +2,169 @@ package repository
 
 import (
 	"context"
+	"time"
 
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
 	"github.com/Schera-ole/loyalty_system/internal/model"
 )
 
-type Repository interface {
+// UserStore handles account registration and authentication, including the
+// WebAuthn passkey credentials and ceremony session state used by the
+// passwordless login flow alongside password auth.
+type UserStore interface {
 	SetUser(ctx context.Context, user model.User) error
 	CheckUser(ctx context.Context, user model.User) (bool, error)
+	// UserExists reports whether username is already registered, without
+	// checking a password - unlike CheckUser, it's safe to call with no
+	// credentials, for an availability pre-check.
+	UserExists(ctx context.Context, username string) (bool, error)
+
+	// RegisterCredential binds a newly-enrolled WebAuthn credential to username.
+	RegisterCredential(ctx context.Context, username string, cred model.WebAuthnCredential) error
+	// GetCredentialsByUser returns the WebAuthn credentials bound to username.
+	GetCredentialsByUser(ctx context.Context, username string) ([]model.WebAuthnCredential, error)
+	// UpdateCredentialCounter persists an authenticator's signature counter
+	// after a successful assertion, so a cloned authenticator can be detected.
+	UpdateCredentialCounter(ctx context.Context, credentialID []byte, signCount uint32) error
+
+	// SaveWebAuthnSession stashes in-flight ceremony session data (challenge,
+	// allowed credentials) for sessionID, read back by the matching finish step.
+	SaveWebAuthnSession(ctx context.Context, sessionID string, data []byte) error
+	// GetWebAuthnSession retrieves session data saved by SaveWebAuthnSession.
+	GetWebAuthnSession(ctx context.Context, sessionID string) ([]byte, error)
+	// DeleteWebAuthnSession removes session data once a ceremony finishes.
+	DeleteWebAuthnSession(ctx context.Context, sessionID string) error
+
+	// LinkOrCreateFederatedUser resolves an OAuth2/OIDC identity (provider +
+	// the provider's stable subject ID) to a username: an identity seen
+	// before returns the username it's already linked to; one sharing email
+	// with an existing federated identity links to that same account instead
+	// of creating a duplicate; otherwise a new federated-only account (no
+	// password) is provisioned.
+	LinkOrCreateFederatedUser(ctx context.Context, provider string, subject string, email string) (string, error)
+
+	// LinkFederatedIdentityToUser attaches provider+subject to the already
+	// authenticated username, so a password (or passkey) account can add a
+	// social login without going through the unauthenticated email-matching
+	// path in LinkOrCreateFederatedUser. Returns
+	// apperrors.ErrFederatedIdentityLinked if that identity is already linked
+	// to a different account.
+	LinkFederatedIdentityToUser(ctx context.Context, username string, provider string, subject string, email string) error
+
+	// CreateRefreshSession persists a newly-issued refresh token, hashed by
+	// the caller, alongside the access-token jti it was issued with.
+	CreateRefreshSession(ctx context.Context, session model.RefreshSession) error
+	// GetRefreshSessionByHash looks up a refresh session by its token hash,
+	// regardless of whether it has since been revoked - callers that care
+	// need to check RevokedAt themselves to distinguish unknown-token from
+	// already-used-token (replay).
+	GetRefreshSessionByHash(ctx context.Context, tokenHash string) (model.RefreshSession, error)
+	// RevokeRefreshSession marks a single refresh session (by token hash) as
+	// revoked, if it isn't already. Used only when superseding a session
+	// during rotation: keeping the row around as a tombstone, rather than
+	// deleting it, is what lets a later replay of that same token be told
+	// apart from a token that was simply never issued.
+	RevokeRefreshSession(ctx context.Context, tokenHash string) error
+	// DeleteRefreshSessionByHash removes a refresh session outright, for a
+	// deliberate end to that session (logout) rather than rotation. Unlike
+	// RevokeRefreshSession it leaves no tombstone, so presenting that same
+	// token again is reported as unknown rather than as a replay - a user
+	// intentionally logging out isn't an attack, and shouldn't cascade-revoke
+	// their other sessions the way RotateRefreshSession's replay detection
+	// does. A missing row is not an error: logout is idempotent.
+	DeleteRefreshSessionByHash(ctx context.Context, tokenHash string) error
+	// RevokeRefreshSessionByJTI removes the refresh session issued alongside
+	// access-token jti, scoped to username so one user can't revoke another's
+	// session by guessing its jti. Like DeleteRefreshSessionByHash this is a
+	// deliberate single-session revoke (the sessions-audit "log out this
+	// device" action), so it deletes rather than tombstones. Reports
+	// apperrors.ErrRefreshTokenNotFound if no matching, active session exists
+	// for that user.
+	RevokeRefreshSessionByJTI(ctx context.Context, username string, jti string) error
+	// RevokeAllRefreshSessions revokes every refresh session belonging to
+	// username, used to tear down every active session on a detected replay.
+	RevokeAllRefreshSessions(ctx context.Context, username string) error
+	// ListActiveRefreshSessions returns username's not-yet-revoked,
+	// not-yet-expired refresh sessions, for a sessions-audit view.
+	ListActiveRefreshSessions(ctx context.Context, username string) ([]model.RefreshSession, error)
+
+	// RevokeAccessJTI denylists an access token's jti until expiresAt, so it
+	// stops being accepted before its signature would naturally expire.
+	RevokeAccessJTI(ctx context.Context, jti string, expiresAt time.Time) error
+	// IsAccessJTIRevoked reports whether jti has been denylisted by
+	// RevokeAccessJTI.
+	IsAccessJTIRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// OrderStore handles order submission, status transitions, and the
+// accrual-poll job queue that drives those transitions. A poll job always
+// corresponds 1:1 to a non-final order, so the job queue lives alongside
+// order lifecycle rather than as its own store.
+type OrderStore interface {
 	AddOrder(ctx context.Context, username string, orderNumber string) error
 	UpdateOrderStatus(ctx context.Context, orderNumber string, status string) error
 	UpdateOrderStatusAndAccrual(ctx context.Context, orderNumber string, status string, accrual *float64) error
 	GetOrders(ctx context.Context, username string) ([]model.Order, error)
+
+	// EnqueuePollJob schedules an accrual-poll job for orderNumber, due immediately.
+	EnqueuePollJob(ctx context.Context, orderNumber string) error
+	// ClaimDuePollJobs claims up to limit due jobs using SELECT ... FOR UPDATE SKIP LOCKED
+	// so multiple replicas can drain the queue concurrently.
+	ClaimDuePollJobs(ctx context.Context, limit int) ([]model.PollJob, error)
+	// CompletePollJob records the order's final status/accrual and removes its job
+	// in a single transaction.
+	CompletePollJob(ctx context.Context, orderNumber string, status string, accrual *float64) error
+	// CompletePollJobsBatch applies many final poll results in a single
+	// transaction, so the accrual worker can drain a round of PROCESSED/INVALID
+	// results in one DB round-trip instead of one CompletePollJob per order.
+	CompletePollJobsBatch(ctx context.Context, results []model.AccrualResponse) error
+	// ReschedulePollJob bumps attempts and pushes next_attempt_at out for a job that
+	// needs another poll.
+	ReschedulePollJob(ctx context.Context, orderNumber string, nextAttemptAt time.Time) error
+}
+
+// LedgerStore handles the double-entry balance ledger: reads of derived
+// balances/withdrawals, and the atomic posting of new transactions.
+type LedgerStore interface {
 	GetUserBalance(ctx context.Context, username string) (model.UserBalance, error)
 	GetWithdrawals(ctx context.Context, username string) ([]model.Withdrawal, error)
 	SpendPoints(ctx context.Context, orderWithdrawal model.OrderWithdrawal) error
+	// PostTransaction atomically writes a ledger transaction header and its
+	// postings.
+	PostTransaction(ctx context.Context, transaction ledger.Transaction) error
+
+	// SpendPointsIdempotent posts a withdrawal transaction keyed by key: a
+	// retry using the same key after a timeout or crash replays as a no-op
+	// instead of debiting the balance twice.
+	SpendPointsIdempotent(ctx context.Context, key string, orderWithdrawal model.OrderWithdrawal) error
+	// CreditAccrualIdempotent posts an accrual credit for orderNumber keyed
+	// by key, so the accrual poller can retry the same PROCESSED result
+	// without double-crediting.
+	CreditAccrualIdempotent(ctx context.Context, key string, orderNumber string, amount float64) error
+	// RecomputeBalance re-derives a user's balance straight from the ledger,
+	// for reconciliation tooling to assert against GetUserBalance's result.
+	RecomputeBalance(ctx context.Context, username string) (model.UserBalance, error)
+}
+
+// HealthChecker reports whether a backend is reachable.
+type HealthChecker interface {
 	Ping(ctx context.Context) error
+
+	// ProbeWrite exercises a real write-then-delete round trip against the
+	// backend, so health.Checker can catch a read-only or degraded
+	// database that would still answer Ping successfully.
+	ProbeWrite(ctx context.Context) error
+}
+
+// Repository is the full backend contract implemented by DBStorage and
+// memstore.Store. Consumers that only need part of it should depend on the
+// narrower UserStore/OrderStore/LedgerStore/HealthChecker interfaces
+// instead.
+type Repository interface {
+	UserStore
+	OrderStore
+	LedgerStore
+	HealthChecker
+
 	Close() error
 }
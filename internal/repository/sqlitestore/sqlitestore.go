@@ -0,0 +1,1129 @@
+// Package sqlitestore is a repository.Repository implementation backed by
+// modernc.org/sqlite, for local development, tests, and single-node deploys
+// that don't want to run Postgres. It mirrors DBStorage's queries, adapted
+// for SQLite's placeholder syntax, lack of RETURNING-driven ID generation in
+// the patterns DBStorage uses, and text-only timestamp storage.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Schera-ole/loyalty_system/internal/auth"
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
+	"github.com/Schera-ole/loyalty_system/internal/ledger"
+	"github.com/Schera-ole/loyalty_system/internal/migration"
+	"github.com/Schera-ole/loyalty_system/internal/model"
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+// timeLayout is the format every TEXT timestamp column is written in and
+// parsed from; SQLite has no native timestamp type to round-trip time.Time
+// through database/sql the way Postgres does.
+const timeLayout = time.RFC3339Nano
+
+type Storage struct {
+	db *sql.DB
+}
+
+// New opens a SQLite database at dsn (a file path or ":memory:") and
+// migrates it. Connections are capped at one: SQLite serializes writers
+// anyway, a second connection to ":memory:" would see an empty database
+// instead of the one New just migrated, and a single connection means
+// concurrent callers block instead of failing with SQLITE_BUSY.
+func New(dsn string) (*Storage, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := migration.RunOn(context.Background(), db, migration.DialectSQLite); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{db: db}, nil
+}
+
+func (storage *Storage) Close() error {
+	return storage.db.Close()
+}
+
+func (storage *Storage) Ping(ctx context.Context) error {
+	return storage.db.PingContext(ctx)
+}
+
+// ProbeWrite inserts then deletes a throwaway row in health_probes, so a
+// read-only or otherwise degraded database - which would still answer Ping
+// - shows up as unhealthy.
+func (storage *Storage) ProbeWrite(ctx context.Context) error {
+	id := uuid.NewString()
+	if _, err := storage.db.ExecContext(ctx, "INSERT INTO health_probes (id, created_at) VALUES (?, ?)", id, formatTime(time.Now())); err != nil {
+		return fmt.Errorf("error writing health probe: %w", err)
+	}
+	if _, err := storage.db.ExecContext(ctx, "DELETE FROM health_probes WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting health probe: %w", err)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(timeLayout, value)
+}
+
+func (storage *Storage) SetUser(ctx context.Context, user model.User) error {
+	if user.Username == "" || user.Password == "" {
+		return apperrors.ErrInvalidRequest
+	}
+
+	passwordHash, err := auth.HashPassword(user.Password)
+	if err != nil {
+		return apperrors.ErrPasswordHashing
+	}
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	exists, err := storage.userExists(ctx, tx, user.Username)
+	if err != nil {
+		return fmt.Errorf("error checking user existence: %w", err)
+	}
+	if exists {
+		err = apperrors.ErrUserAlreadyExists
+		return err
+	}
+
+	now := formatTime(time.Now())
+	query := "INSERT INTO users (id, username, password_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err = tx.ExecContext(ctx, query, uuid.NewString(), user.Username, passwordHash, now, now); err != nil {
+		return fmt.Errorf("error saving user: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) CheckUser(ctx context.Context, user model.User) (bool, error) {
+	if user.Username == "" || user.Password == "" {
+		return false, apperrors.ErrInvalidCredentials
+	}
+
+	var storedHash string
+	query := "SELECT password_hash FROM users WHERE username = ?"
+	err := storage.db.QueryRowContext(ctx, query, user.Username).Scan(&storedHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, apperrors.ErrUserNotFound
+		}
+		return false, fmt.Errorf("error retrieving user: %w", err)
+	}
+
+	if err := auth.CheckPassword(user.Password, storedHash); err != nil {
+		return false, apperrors.ErrInvalidPassword
+	}
+	return true, nil
+}
+
+func (storage *Storage) userExists(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, username string) (bool, error) {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	return exists, err
+}
+
+func (storage *Storage) UserExists(ctx context.Context, username string) (bool, error) {
+	exists, err := storage.userExists(ctx, storage.db, username)
+	if err != nil {
+		return false, fmt.Errorf("error checking if user exists: %w", err)
+	}
+	return exists, nil
+}
+
+func (storage *Storage) userID(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, username string) (string, error) {
+	var userID string
+	err := q.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", apperrors.ErrUserNotFound
+	}
+	return userID, err
+}
+
+func (storage *Storage) AddOrder(ctx context.Context, username string, orderNumber string) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	userID, err := storage.userID(ctx, tx, username)
+	if err != nil {
+		if err == apperrors.ErrUserNotFound {
+			return err
+		}
+		return fmt.Errorf("error getting user ID: %w", err)
+	}
+
+	var existingUserID string
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE order_number = ?", orderNumber).Scan(&existingUserID)
+	if err == nil {
+		if existingUserID == userID {
+			err = apperrors.ErrOrderAlreadyExists
+		} else {
+			err = apperrors.ErrOrderOwnedByAnotherUser
+		}
+		return err
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking order existence: %w", err)
+	}
+
+	now := formatTime(time.Now())
+	insertQuery := "INSERT INTO orders (order_number, user_id, status, uploaded_at, updated_at) VALUES (?, ?, 'NEW', ?, ?)"
+	if _, err = tx.ExecContext(ctx, insertQuery, orderNumber, userID, now, now); err != nil {
+		return fmt.Errorf("error inserting order: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) UpdateOrderStatus(ctx context.Context, orderNumber string, status string) error {
+	query := "UPDATE orders SET status = ?, updated_at = ? WHERE order_number = ?"
+	_, err := storage.db.ExecContext(ctx, query, status, formatTime(time.Now()), orderNumber)
+	if err != nil {
+		return fmt.Errorf("error updating order status: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) UpdateOrderStatusAndAccrual(ctx context.Context, orderNumber string, status string, accrual *float64) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	username, err := usernameForOrder(ctx, tx, orderNumber)
+	if err != nil {
+		return err
+	}
+
+	updateOrderQuery := "UPDATE orders SET status = ?, accrual = ?, updated_at = ? WHERE order_number = ?"
+	if _, err = tx.ExecContext(ctx, updateOrderQuery, status, accrual, formatTime(time.Now()), orderNumber); err != nil {
+		return fmt.Errorf("error updating order status and accrual: %w", err)
+	}
+
+	if status == "PROCESSED" && accrual != nil && *accrual > 0 {
+		if err = creditAccrualPosting(ctx, tx, ledger.AccrualTxID(orderNumber), username, orderNumber, *accrual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usernameForOrder looks up the username owning orderNumber, for the
+// accrual-crediting paths that need it inside an open transaction.
+func usernameForOrder(ctx context.Context, tx *sql.Tx, orderNumber string) (string, error) {
+	var username string
+	query := `
+		SELECT u.username FROM orders o
+		INNER JOIN users u ON o.user_id = u.id
+		WHERE o.order_number = ?
+	`
+	if err := tx.QueryRowContext(ctx, query, orderNumber).Scan(&username); err != nil {
+		return "", fmt.Errorf("error getting user for order: %w", err)
+	}
+	return username, nil
+}
+
+// creditAccrualPosting posts an accrual credit transaction keyed by txid, so
+// calling it twice for the same key (e.g. a retried status update) can't
+// double-credit the order.
+func creditAccrualPosting(ctx context.Context, tx *sql.Tx, txid string, username string, orderNumber string, amount float64) error {
+	txn := ledger.NewAccrualTransaction(txid, username, orderNumber, amount)
+	return insertLedgerTransaction(ctx, tx, txn)
+}
+
+func (storage *Storage) GetOrders(ctx context.Context, username string) ([]model.Order, error) {
+	var orders []model.Order
+	query := `
+		SELECT o.order_number, o.status, o.accrual, o.uploaded_at
+		FROM orders o
+		INNER JOIN users u ON o.user_id = u.id
+		WHERE u.username = ?
+		ORDER BY o.uploaded_at DESC
+	`
+	rows, err := storage.db.QueryContext(ctx, query, username)
+	if err != nil {
+		return orders, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var order model.Order
+		var uploadedAt string
+		if err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &uploadedAt); err != nil {
+			return orders, fmt.Errorf("error scanning row: %w", err)
+		}
+		if order.UploadedAt, err = parseTime(uploadedAt); err != nil {
+			return orders, fmt.Errorf("error parsing uploaded_at: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return orders, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return orders, nil
+}
+
+func (storage *Storage) GetUserBalance(ctx context.Context, username string) (model.UserBalance, error) {
+	var userBalance model.UserBalance
+	query := `
+		SELECT
+			COALESCE((SELECT SUM(amount) FROM postings WHERE account = ?), 0),
+			COALESCE((SELECT SUM(amount) FROM postings WHERE account = ?), 0)
+		FROM users WHERE username = ?
+	`
+	err := storage.db.QueryRowContext(ctx, query, ledger.AvailableAccount(username), ledger.SpentAccount(username), username).
+		Scan(&userBalance.Balance, &userBalance.TotalSpent)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return userBalance, apperrors.ErrBalanceNotFound
+		}
+		return userBalance, fmt.Errorf("error retrieving balance: %w", err)
+	}
+	return userBalance, nil
+}
+
+func (storage *Storage) GetWithdrawals(ctx context.Context, username string) ([]model.Withdrawal, error) {
+	var withdrawals []model.Withdrawal
+	query := `
+		SELECT t.order_number, p.amount, t.created_at
+		FROM transactions t
+		INNER JOIN postings p ON p.txid = t.txid AND p.account = ?
+		WHERE t.kind = 'withdrawal'
+		ORDER BY t.created_at DESC
+	`
+	rows, err := storage.db.QueryContext(ctx, query, ledger.SpentAccount(username))
+	if err != nil {
+		return withdrawals, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var withdrawal model.Withdrawal
+		var processedAt string
+		if err := rows.Scan(&withdrawal.Order, &withdrawal.Sum, &processedAt); err != nil {
+			return withdrawals, fmt.Errorf("error scanning row: %w", err)
+		}
+		if withdrawal.ProcessedAt, err = parseTime(processedAt); err != nil {
+			return withdrawals, fmt.Errorf("error parsing created_at: %w", err)
+		}
+		withdrawals = append(withdrawals, withdrawal)
+	}
+	if err := rows.Err(); err != nil {
+		return withdrawals, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return withdrawals, nil
+}
+
+func (storage *Storage) SpendPoints(ctx context.Context, orderWithdrawal model.OrderWithdrawal) error {
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return fmt.Errorf("error checking user existence: %w", err)
+	}
+	if !exists {
+		err = apperrors.ErrBalanceNotFound
+		return err
+	}
+
+	availableAccount := ledger.AvailableAccount(username)
+	var currentBalance float64
+	if err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account = ?", availableAccount).Scan(&currentBalance); err != nil {
+		return fmt.Errorf("error checking user balance: %w", err)
+	}
+
+	if orderWithdrawal.Sum > currentBalance {
+		err = apperrors.ErrInsufficientFunds
+		return err
+	}
+
+	txn := ledger.NewWithdrawalTransaction(uuid.NewString(), username, orderWithdrawal.Order, orderWithdrawal.Sum)
+	if err = insertLedgerTransaction(ctx, tx, txn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SpendPointsIdempotent is SpendPoints keyed by an idempotency key: a
+// retried request with the same key finds its transaction already posted
+// and returns success without re-checking or re-debiting the balance.
+func (storage *Storage) SpendPointsIdempotent(ctx context.Context, key string, orderWithdrawal model.OrderWithdrawal) error {
+	if orderWithdrawal.User == nil || *orderWithdrawal.User == "" {
+		return apperrors.ErrInvalidRequest
+	}
+	username := *orderWithdrawal.User
+	txid := ledger.WithdrawalTxID(key)
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return fmt.Errorf("error checking user existence: %w", err)
+	}
+	if !exists {
+		err = apperrors.ErrBalanceNotFound
+		return err
+	}
+
+	var alreadyPosted bool
+	if err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM transactions WHERE txid = ?)", txid).Scan(&alreadyPosted); err != nil {
+		return fmt.Errorf("error checking idempotency key: %w", err)
+	}
+	if alreadyPosted {
+		return nil
+	}
+
+	availableAccount := ledger.AvailableAccount(username)
+	var currentBalance float64
+	if err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account = ?", availableAccount).Scan(&currentBalance); err != nil {
+		return fmt.Errorf("error checking user balance: %w", err)
+	}
+
+	if orderWithdrawal.Sum > currentBalance {
+		err = apperrors.ErrInsufficientFunds
+		return err
+	}
+
+	txn := ledger.NewWithdrawalTransaction(txid, username, orderWithdrawal.Order, orderWithdrawal.Sum)
+	if err = insertLedgerTransaction(ctx, tx, txn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreditAccrualIdempotent is the credit half of UpdateOrderStatusAndAccrual,
+// exposed directly so the accrual poller can retry crediting a PROCESSED
+// order without going through a full status update, and without
+// double-crediting on retry.
+func (storage *Storage) CreditAccrualIdempotent(ctx context.Context, key string, orderNumber string, amount float64) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	username, err := usernameForOrder(ctx, tx, orderNumber)
+	if err != nil {
+		return err
+	}
+
+	err = creditAccrualPosting(ctx, tx, ledger.AccrualTxID(key), username, orderNumber, amount)
+	return err
+}
+
+// RecomputeBalance re-derives a user's balance straight from the ledger.
+// GetUserBalance already computes it this way on every call instead of from
+// a cache, so this is the same query exposed as its own entrypoint for
+// reconciliation tooling to assert the two agree.
+func (storage *Storage) RecomputeBalance(ctx context.Context, username string) (model.UserBalance, error) {
+	return storage.GetUserBalance(ctx, username)
+}
+
+func (storage *Storage) PostTransaction(ctx context.Context, transaction ledger.Transaction) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	err = insertLedgerTransaction(ctx, tx, transaction)
+	return err
+}
+
+// insertLedgerTransaction writes the transaction header and its postings
+// within an already-open *sql.Tx. A header insert that collides with an
+// already-posted TxID is treated as a successful replay rather than an
+// error, so callers that derive TxID deterministically (ledger.AccrualTxID,
+// ledger.WithdrawalTxID) get idempotent posting for free.
+func insertLedgerTransaction(ctx context.Context, tx *sql.Tx, transaction ledger.Transaction) error {
+	metadata, err := json.Marshal(transaction.Metadata)
+	if err != nil {
+		return fmt.Errorf("error marshaling transaction metadata: %w", err)
+	}
+
+	now := formatTime(time.Now())
+	insertHeaderQuery := "INSERT INTO transactions (txid, order_number, kind, metadata, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (txid) DO NOTHING"
+	result, err := tx.ExecContext(ctx, insertHeaderQuery, transaction.TxID, transaction.Order, transaction.Kind, metadata, now)
+	if err != nil {
+		return fmt.Errorf("error inserting transaction header: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error checking transaction insert: %w", err)
+	} else if rows == 0 {
+		return nil
+	}
+
+	insertPostingQuery := "INSERT INTO postings (txid, account, amount, created_at) VALUES (?, ?, ?, ?)"
+	for _, posting := range transaction.Postings {
+		if _, err := tx.ExecContext(ctx, insertPostingQuery, transaction.TxID, posting.Account, posting.Amount, now); err != nil {
+			return fmt.Errorf("error inserting posting: %w", err)
+		}
+	}
+	return nil
+}
+
+func (storage *Storage) EnqueuePollJob(ctx context.Context, orderNumber string) error {
+	query := `
+		INSERT INTO accrual_poll_jobs (order_number, next_attempt_at, attempts, state)
+		VALUES (?, ?, 0, 'PENDING')
+		ON CONFLICT (order_number) DO NOTHING
+	`
+	_, err := storage.db.ExecContext(ctx, query, orderNumber, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error enqueueing poll job: %w", err)
+	}
+	return nil
+}
+
+// ClaimDuePollJobs claims up to limit due jobs. SQLite serializes all
+// writers against a single database file, so a plain transaction gives the
+// same exclusivity that FOR UPDATE SKIP LOCKED gives DBStorage against
+// Postgres, just without the concurrent-replica throughput.
+func (storage *Storage) ClaimDuePollJobs(ctx context.Context, limit int) ([]model.PollJob, error) {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	query := `
+		SELECT order_number, next_attempt_at, attempts, state
+		FROM accrual_poll_jobs
+		WHERE next_attempt_at <= ? AND state = 'PENDING'
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`
+	rows, err := tx.QueryContext(ctx, query, formatTime(time.Now()), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming poll jobs: %w", err)
+	}
+
+	var jobs []model.PollJob
+	var nextAttemptAts []string
+	for rows.Next() {
+		var job model.PollJob
+		var nextAttemptAt string
+		if err = rows.Scan(&job.OrderNumber, &nextAttemptAt, &job.Attempts, &job.State); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning poll job: %w", err)
+		}
+		nextAttemptAts = append(nextAttemptAts, nextAttemptAt)
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("error iterating poll jobs: %w", err)
+	}
+	rows.Close()
+
+	for i := range jobs {
+		if jobs[i].NextAttemptAt, err = parseTime(nextAttemptAts[i]); err != nil {
+			return nil, fmt.Errorf("error parsing next_attempt_at: %w", err)
+		}
+	}
+
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+
+	claimQuery := "UPDATE accrual_poll_jobs SET state = 'CLAIMED' WHERE order_number = ?"
+	for _, job := range jobs {
+		if _, err = tx.ExecContext(ctx, claimQuery, job.OrderNumber); err != nil {
+			return nil, fmt.Errorf("error marking poll job claimed: %w", err)
+		}
+	}
+	return jobs, nil
+}
+
+func (storage *Storage) CompletePollJob(ctx context.Context, orderNumber string, status string, accrual *float64) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	username, err := usernameForOrder(ctx, tx, orderNumber)
+	if err != nil {
+		return err
+	}
+
+	updateOrderQuery := "UPDATE orders SET status = ?, accrual = ?, updated_at = ? WHERE order_number = ?"
+	if _, err = tx.ExecContext(ctx, updateOrderQuery, status, accrual, formatTime(time.Now()), orderNumber); err != nil {
+		return fmt.Errorf("error updating order status and accrual: %w", err)
+	}
+
+	if status == "PROCESSED" && accrual != nil && *accrual > 0 {
+		if err = creditAccrualPosting(ctx, tx, ledger.AccrualTxID(orderNumber), username, orderNumber, *accrual); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM accrual_poll_jobs WHERE order_number = ?", orderNumber); err != nil {
+		return fmt.Errorf("error deleting poll job: %w", err)
+	}
+	return nil
+}
+
+// CompletePollJobsBatch applies every result in one transaction: each order's
+// status/accrual update, ledger credit, and poll job deletion run in a loop
+// within the single transaction, so the accrual worker pays for one
+// commit per drained batch instead of one per order.
+func (storage *Storage) CompletePollJobsBatch(ctx context.Context, results []model.AccrualResponse) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	now := formatTime(time.Now())
+	for _, result := range results {
+		username, lookupErr := usernameForOrder(ctx, tx, result.Order)
+		if lookupErr != nil {
+			if errors.Is(lookupErr, sql.ErrNoRows) {
+				// The order vanished between ClaimDuePollJobs and here; skip
+				// it rather than failing the whole batch and leaving every
+				// other claimed job stuck.
+				continue
+			}
+			err = fmt.Errorf("error getting user for order %s: %w", result.Order, lookupErr)
+			return err
+		}
+
+		updateOrderQuery := "UPDATE orders SET status = ?, accrual = ?, updated_at = ? WHERE order_number = ?"
+		if _, err = tx.ExecContext(ctx, updateOrderQuery, result.Status, result.Accrual, now, result.Order); err != nil {
+			return fmt.Errorf("error updating order status and accrual: %w", err)
+		}
+
+		if result.Status == "PROCESSED" && result.Accrual != nil && *result.Accrual > 0 {
+			if err = creditAccrualPosting(ctx, tx, ledger.AccrualTxID(result.Order), username, result.Order, *result.Accrual); err != nil {
+				return err
+			}
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM accrual_poll_jobs WHERE order_number = ?", result.Order); err != nil {
+			return fmt.Errorf("error deleting poll job: %w", err)
+		}
+	}
+	return nil
+}
+
+func (storage *Storage) ReschedulePollJob(ctx context.Context, orderNumber string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE accrual_poll_jobs
+		SET attempts = attempts + 1, next_attempt_at = ?, state = 'PENDING'
+		WHERE order_number = ?
+	`
+	_, err := storage.db.ExecContext(ctx, query, formatTime(nextAttemptAt), orderNumber)
+	if err != nil {
+		return fmt.Errorf("error rescheduling poll job: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) RegisterCredential(ctx context.Context, username string, cred model.WebAuthnCredential) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	userID, err := storage.userID(ctx, tx, username)
+	if err != nil {
+		if err == apperrors.ErrUserNotFound {
+			return err
+		}
+		return fmt.Errorf("error getting user ID: %w", err)
+	}
+
+	transports, err := json.Marshal(cred.Transports)
+	if err != nil {
+		return fmt.Errorf("error marshaling credential transports: %w", err)
+	}
+
+	insertQuery := `
+		INSERT INTO webauthn_credentials (credential_id, user_id, public_key, sign_count, aaguid, transports, attestation_json, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err = tx.ExecContext(ctx, insertQuery, cred.CredentialID, userID, cred.PublicKey, cred.SignCount, cred.AAGUID, transports, cred.AttestationJSON, formatTime(time.Now())); err != nil {
+		return fmt.Errorf("error saving webauthn credential: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) GetCredentialsByUser(ctx context.Context, username string) ([]model.WebAuthnCredential, error) {
+	var credentials []model.WebAuthnCredential
+	query := `
+		SELECT c.credential_id, c.public_key, c.sign_count, c.aaguid, c.transports, c.attestation_json
+		FROM webauthn_credentials c
+		INNER JOIN users u ON c.user_id = u.id
+		WHERE u.username = ?
+	`
+	rows, err := storage.db.QueryContext(ctx, query, username)
+	if err != nil {
+		return credentials, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cred model.WebAuthnCredential
+		var transports []byte
+		if err := rows.Scan(&cred.CredentialID, &cred.PublicKey, &cred.SignCount, &cred.AAGUID, &transports, &cred.AttestationJSON); err != nil {
+			return credentials, fmt.Errorf("error scanning row: %w", err)
+		}
+		if err := json.Unmarshal(transports, &cred.Transports); err != nil {
+			return credentials, fmt.Errorf("error unmarshaling credential transports: %w", err)
+		}
+		credentials = append(credentials, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return credentials, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return credentials, nil
+}
+
+func (storage *Storage) UpdateCredentialCounter(ctx context.Context, credentialID []byte, signCount uint32) error {
+	query := "UPDATE webauthn_credentials SET sign_count = ? WHERE credential_id = ?"
+	_, err := storage.db.ExecContext(ctx, query, signCount, credentialID)
+	if err != nil {
+		return fmt.Errorf("error updating credential counter: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) SaveWebAuthnSession(ctx context.Context, sessionID string, data []byte) error {
+	query := `
+		INSERT INTO webauthn_sessions (session_id, data, created_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET data = EXCLUDED.data, created_at = EXCLUDED.created_at
+	`
+	_, err := storage.db.ExecContext(ctx, query, sessionID, data, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error saving webauthn session: %w", err)
+	}
+	return nil
+}
+
+func (storage *Storage) GetWebAuthnSession(ctx context.Context, sessionID string) ([]byte, error) {
+	var data []byte
+	err := storage.db.QueryRowContext(ctx, "SELECT data FROM webauthn_sessions WHERE session_id = ?", sessionID).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, apperrors.ErrWebAuthnSessionNotFound
+		}
+		return nil, fmt.Errorf("error retrieving webauthn session: %w", err)
+	}
+	return data, nil
+}
+
+func (storage *Storage) DeleteWebAuthnSession(ctx context.Context, sessionID string) error {
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM webauthn_sessions WHERE session_id = ?", sessionID)
+	if err != nil {
+		return fmt.Errorf("error deleting webauthn session: %w", err)
+	}
+	return nil
+}
+
+// LinkOrCreateFederatedUser resolves provider+subject to a username,
+// provisioning an account the first time an identity is seen. New caps the
+// pool at a single connection, which already serializes this against a
+// concurrent link of the same identity, so no retry loop is needed here.
+func (storage *Storage) LinkOrCreateFederatedUser(ctx context.Context, provider string, subject string, email string) (string, error) {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	var username string
+	lookupQuery := `
+		SELECT u.username FROM federated_identities f
+		INNER JOIN users u ON f.user_id = u.id
+		WHERE f.provider = ? AND f.subject = ?
+	`
+	err = tx.QueryRowContext(ctx, lookupQuery, provider, subject).Scan(&username)
+	if err == nil {
+		return username, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("error looking up federated identity: %w", err)
+	}
+
+	var userID string
+	if email != "" {
+		emailQuery := `
+			SELECT u.id, u.username FROM federated_identities f
+			INNER JOIN users u ON f.user_id = u.id
+			WHERE f.email = ?
+			LIMIT 1
+		`
+		err = tx.QueryRowContext(ctx, emailQuery, email).Scan(&userID, &username)
+	} else {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		username = federatedUsername(provider, subject)
+		now := formatTime(time.Now())
+		userID = uuid.NewString()
+		insertUserQuery := "INSERT INTO users (id, username, password_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?)"
+		if _, err = tx.ExecContext(ctx, insertUserQuery, userID, username, "", now, now); err != nil {
+			return "", fmt.Errorf("error creating federated user: %w", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("error looking up federated identity by email: %w", err)
+	}
+
+	insertIdentityQuery := `
+		INSERT INTO federated_identities (id, user_id, provider, subject, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	if _, err = tx.ExecContext(ctx, insertIdentityQuery, uuid.NewString(), userID, provider, subject, email, formatTime(time.Now())); err != nil {
+		return "", fmt.Errorf("error saving federated identity: %w", err)
+	}
+	return username, nil
+}
+
+// LinkFederatedIdentityToUser attaches provider+subject to an already
+// authenticated user, so an existing password (or passkey) account can add a
+// social login directly instead of relying on LinkOrCreateFederatedUser's
+// unauthenticated email match, which never fires for an account that has
+// never linked a provider before.
+func (storage *Storage) LinkFederatedIdentityToUser(ctx context.Context, username string, provider string, subject string, email string) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	var userID string
+	if err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = apperrors.ErrUserNotFound
+		} else {
+			err = fmt.Errorf("error looking up user: %w", err)
+		}
+		return err
+	}
+
+	var existingUserID string
+	lookupQuery := `SELECT user_id FROM federated_identities WHERE provider = ? AND subject = ?`
+	lookupErr := tx.QueryRowContext(ctx, lookupQuery, provider, subject).Scan(&existingUserID)
+	if lookupErr == nil {
+		if existingUserID != userID {
+			err = apperrors.ErrFederatedIdentityLinked
+		}
+		return err
+	}
+	if !errors.Is(lookupErr, sql.ErrNoRows) {
+		err = fmt.Errorf("error looking up federated identity: %w", lookupErr)
+		return err
+	}
+
+	insertIdentityQuery := `
+		INSERT INTO federated_identities (id, user_id, provider, subject, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	if _, err = tx.ExecContext(ctx, insertIdentityQuery, uuid.NewString(), userID, provider, subject, email, formatTime(time.Now())); err != nil {
+		err = fmt.Errorf("error saving federated identity: %w", err)
+		return err
+	}
+	return nil
+}
+
+// federatedUsername derives a stable, collision-free username for a
+// federated-only account: provider identities are already unique per
+// provider, so "<provider>:<subject>" can't collide with another federated
+// account or a password-registered one picking an ordinary name.
+func federatedUsername(provider string, subject string) string {
+	return provider + ":" + subject
+}
+
+// CreateRefreshSession persists a newly-issued refresh token, hashed by the
+// caller, alongside the access-token jti it was issued with.
+func (storage *Storage) CreateRefreshSession(ctx context.Context, session model.RefreshSession) error {
+	userID, err := storage.userID(ctx, storage.db, session.Username)
+	if err != nil {
+		return fmt.Errorf("error getting user ID: %w", err)
+	}
+
+	query := `
+		INSERT INTO refresh_tokens (user_id, token_hash, access_jti, issued_at, expires_at, user_agent, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err := storage.db.ExecContext(ctx, query, userID, session.TokenHash, session.AccessJTI, formatTime(session.IssuedAt), formatTime(session.ExpiresAt), session.UserAgent, session.IP); err != nil {
+		return fmt.Errorf("error saving refresh session: %w", err)
+	}
+	return nil
+}
+
+// GetRefreshSessionByHash looks up a refresh session by its token hash,
+// revoked or not.
+func (storage *Storage) GetRefreshSessionByHash(ctx context.Context, tokenHash string) (model.RefreshSession, error) {
+	query := `
+		SELECT u.username, r.token_hash, r.access_jti, r.issued_at, r.expires_at, r.revoked_at, r.user_agent, r.ip
+		FROM refresh_tokens r
+		INNER JOIN users u ON r.user_id = u.id
+		WHERE r.token_hash = ?
+	`
+	var session model.RefreshSession
+	var issuedAt, expiresAt string
+	var revokedAt, userAgent, ip sql.NullString
+	err := storage.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&session.Username, &session.TokenHash, &session.AccessJTI, &issuedAt, &expiresAt, &revokedAt, &userAgent, &ip,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return model.RefreshSession{}, apperrors.ErrRefreshTokenNotFound
+		}
+		return model.RefreshSession{}, fmt.Errorf("error retrieving refresh session: %w", err)
+	}
+	if session.IssuedAt, err = parseTime(issuedAt); err != nil {
+		return model.RefreshSession{}, fmt.Errorf("error parsing issued_at: %w", err)
+	}
+	if session.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return model.RefreshSession{}, fmt.Errorf("error parsing expires_at: %w", err)
+	}
+	if revokedAt.Valid {
+		revokedTime, err := parseTime(revokedAt.String)
+		if err != nil {
+			return model.RefreshSession{}, fmt.Errorf("error parsing revoked_at: %w", err)
+		}
+		session.RevokedAt = &revokedTime
+	}
+	session.UserAgent = userAgent.String
+	session.IP = ip.String
+	return session, nil
+}
+
+// RevokeRefreshSession marks the session for tokenHash as revoked, if found
+// and not already revoked.
+func (storage *Storage) RevokeRefreshSession(ctx context.Context, tokenHash string) error {
+	query := "UPDATE refresh_tokens SET revoked_at = ? WHERE token_hash = ? AND revoked_at IS NULL"
+	result, err := storage.db.ExecContext(ctx, query, formatTime(time.Now()), tokenHash)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh session: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return apperrors.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+// DeleteRefreshSessionByHash removes the session for tokenHash outright,
+// leaving no revoked tombstone behind - a missing hash is not an error.
+func (storage *Storage) DeleteRefreshSessionByHash(ctx context.Context, tokenHash string) error {
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return fmt.Errorf("error deleting refresh session: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshSessionByJTI removes the refresh session issued alongside
+// access-token jti, scoped to username.
+func (storage *Storage) RevokeRefreshSessionByJTI(ctx context.Context, username string, jti string) error {
+	query := `
+		DELETE FROM refresh_tokens
+		WHERE access_jti = ? AND revoked_at IS NULL
+		AND user_id = (SELECT id FROM users WHERE username = ?)
+	`
+	result, err := storage.db.ExecContext(ctx, query, jti, username)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh session: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return apperrors.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+// RevokeAllRefreshSessions revokes every refresh session belonging to
+// username, used to tear down every active session on a detected replay.
+func (storage *Storage) RevokeAllRefreshSessions(ctx context.Context, username string) error {
+	query := `
+		UPDATE refresh_tokens SET revoked_at = ?
+		WHERE revoked_at IS NULL AND user_id = (SELECT id FROM users WHERE username = ?)
+	`
+	if _, err := storage.db.ExecContext(ctx, query, formatTime(time.Now()), username); err != nil {
+		return fmt.Errorf("error revoking refresh sessions: %w", err)
+	}
+	return nil
+}
+
+// ListActiveRefreshSessions returns username's not-yet-revoked, not-yet-expired
+// refresh sessions.
+func (storage *Storage) ListActiveRefreshSessions(ctx context.Context, username string) ([]model.RefreshSession, error) {
+	query := `
+		SELECT r.access_jti, r.issued_at, r.expires_at, r.user_agent, r.ip
+		FROM refresh_tokens r
+		INNER JOIN users u ON r.user_id = u.id
+		WHERE u.username = ? AND r.revoked_at IS NULL AND r.expires_at > ?
+		ORDER BY r.issued_at DESC
+	`
+	rows, err := storage.db.QueryContext(ctx, query, username, formatTime(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []model.RefreshSession
+	for rows.Next() {
+		session := model.RefreshSession{Username: username}
+		var issuedAt, expiresAt string
+		var userAgent, ip sql.NullString
+		if err := rows.Scan(&session.AccessJTI, &issuedAt, &expiresAt, &userAgent, &ip); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		if session.IssuedAt, err = parseTime(issuedAt); err != nil {
+			return nil, fmt.Errorf("error parsing issued_at: %w", err)
+		}
+		if session.ExpiresAt, err = parseTime(expiresAt); err != nil {
+			return nil, fmt.Errorf("error parsing expires_at: %w", err)
+		}
+		session.UserAgent = userAgent.String
+		session.IP = ip.String
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return sessions, nil
+}
+
+// RevokeAccessJTI denylists jti until expiresAt.
+func (storage *Storage) RevokeAccessJTI(ctx context.Context, jti string, expiresAt time.Time) error {
+	query := "INSERT OR IGNORE INTO revoked_access_jti (jti, expires_at) VALUES (?, ?)"
+	if _, err := storage.db.ExecContext(ctx, query, jti, formatTime(expiresAt)); err != nil {
+		return fmt.Errorf("error revoking access token: %w", err)
+	}
+	return nil
+}
+
+// IsAccessJTIRevoked reports whether jti has been denylisted by
+// RevokeAccessJTI.
+func (storage *Storage) IsAccessJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM revoked_access_jti WHERE jti = ?)"
+	err := storage.db.QueryRowContext(ctx, query, jti).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking if access token is revoked: %w", err)
+	}
+	return exists, nil
+}
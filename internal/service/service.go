@@ -2,26 +2,77 @@ package service
 
 import (
 	"context"
-	"encoding/json"
-	"net/http"
-	"strconv"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
 	"time"
 
+	apperrors "github.com/Schera-ole/loyalty_system/internal/error"
 	"github.com/Schera-ole/loyalty_system/internal/model"
 	"github.com/Schera-ole/loyalty_system/internal/repository"
 	"go.uber.org/zap"
 )
 
+// AccessTokenTTL and RefreshTokenTTL bound a login session: the access JWT is
+// short-lived so a leaked one self-expires quickly, while the refresh token
+// backing it lives long enough that a user isn't forced to re-authenticate
+// every 15 minutes.
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// reservedUsernames can't be registered even if otherwise well-formed, to
+// keep them free for operational use (status pages, support tooling, etc).
+var reservedUsernames = map[string]struct{}{
+	"admin":         {},
+	"administrator": {},
+	"root":          {},
+	"support":       {},
+	"system":        {},
+}
+
+// ValidateUsername enforces the format shared by registration and the
+// /api/user/validate pre-check, so the two can never disagree: 3-32 chars,
+// lowercase letters/digits/underscore/dot/hyphen, and not reserved.
+func ValidateUsername(username string) error {
+	if len(username) < 3 || len(username) > 32 {
+		return apperrors.ErrInvalidUsername
+	}
+	if !usernamePattern.MatchString(username) {
+		return apperrors.ErrInvalidUsername
+	}
+	if _, reserved := reservedUsernames[username]; reserved {
+		return apperrors.ErrInvalidUsername
+	}
+	return nil
+}
+
+// store is the narrow subset of repository.Repository that the service
+// actually needs: it never reads backend health, so HealthChecker is left out.
+type store interface {
+	repository.UserStore
+	repository.OrderStore
+	repository.LedgerStore
+}
+
 type LoyaltySystemService struct {
-	repo   repository.Repository
+	repo   store
 	logger *zap.SugaredLogger
 }
 
-func NewLoyaltySystemService(repo repository.Repository, logger *zap.SugaredLogger) *LoyaltySystemService {
+func NewLoyaltySystemService(repo store, logger *zap.SugaredLogger) *LoyaltySystemService {
 	return &LoyaltySystemService{repo: repo, logger: logger}
 }
 
 func (lss *LoyaltySystemService) SetUser(ctx context.Context, user model.User) error {
+	if err := ValidateUsername(user.Username); err != nil {
+		return err
+	}
 	return lss.repo.SetUser(ctx, user)
 }
 
@@ -29,6 +80,12 @@ func (lss *LoyaltySystemService) CheckUser(ctx context.Context, user model.User)
 	return lss.repo.CheckUser(ctx, user)
 }
 
+// UserExists reports whether username is already registered, for the
+// /api/user/validate availability pre-check.
+func (lss *LoyaltySystemService) UserExists(ctx context.Context, username string) (bool, error) {
+	return lss.repo.UserExists(ctx, username)
+}
+
 func (lss *LoyaltySystemService) GetOrders(ctx context.Context, username string) ([]model.Order, error) {
 	return lss.repo.GetOrders(ctx, username)
 }
@@ -41,12 +98,36 @@ func (lss *LoyaltySystemService) SpendPoints(ctx context.Context, orderWithdrawa
 	return lss.repo.SpendPoints(ctx, orderWithdrawal)
 }
 
+// SpendPointsIdempotent is SpendPoints keyed by an idempotency key, safe for
+// a client to retry after a timeout without double-spending.
+func (lss *LoyaltySystemService) SpendPointsIdempotent(ctx context.Context, key string, orderWithdrawal model.OrderWithdrawal) error {
+	return lss.repo.SpendPointsIdempotent(ctx, key, orderWithdrawal)
+}
+
+// CreditAccrualIdempotent credits orderNumber's accrual keyed by key, safe
+// for the accrual poller to retry without double-crediting.
+func (lss *LoyaltySystemService) CreditAccrualIdempotent(ctx context.Context, key string, orderNumber string, amount float64) error {
+	return lss.repo.CreditAccrualIdempotent(ctx, key, orderNumber, amount)
+}
+
+// RecomputeBalance re-derives a user's balance straight from the ledger, for
+// reconciliation tooling to assert against GetUserBalance's result.
+func (lss *LoyaltySystemService) RecomputeBalance(ctx context.Context, username string) (model.UserBalance, error) {
+	return lss.repo.RecomputeBalance(ctx, username)
+}
+
 func (lss *LoyaltySystemService) GetWithdrawals(ctx context.Context, username string) ([]model.Withdrawal, error) {
 	return lss.repo.GetWithdrawals(ctx, username)
 }
 
+// AddOrder registers the order and enqueues an accrual-poll job for it. The
+// job is picked up by the worker pool started from main.go instead of a
+// per-order goroutine, so polling survives process restarts.
 func (lss *LoyaltySystemService) AddOrder(ctx context.Context, username string, orderNumber string) error {
-	return lss.repo.AddOrder(ctx, username, orderNumber)
+	if err := lss.repo.AddOrder(ctx, username, orderNumber); err != nil {
+		return err
+	}
+	return lss.repo.EnqueuePollJob(ctx, orderNumber)
 }
 
 func (lss *LoyaltySystemService) UpdateOrderStatus(ctx context.Context, orderNumber string, status string) error {
@@ -57,107 +138,150 @@ func (lss *LoyaltySystemService) UpdateOrderStatusAndAccrual(ctx context.Context
 	return lss.repo.UpdateOrderStatusAndAccrual(ctx, orderNumber, status, accrual)
 }
 
-func (lss *LoyaltySystemService) PollOrderStatus(ctx context.Context, orderNumber string, accrualAddress string) {
-	go func() {
-		timeout := 2 * time.Minute
-		var cancel context.CancelFunc
-		pollCtx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-pollCtx.Done():
-				return
-			case <-ticker.C:
-				accrualURL := accrualAddress + "/api/orders/" + orderNumber
-				resp, err := http.Get(accrualURL)
-				if err != nil {
-					if lss.logger != nil {
-						lss.logger.Errorw("Error making request to accrual system", "error", err, "order", orderNumber)
-					}
-					continue
-				}
-
-				var accrualResponse model.AccrualResponse
-				switch resp.StatusCode {
-				case http.StatusOK:
-					if err := json.NewDecoder(resp.Body).Decode(&accrualResponse); err != nil {
-						resp.Body.Close()
-						if lss.logger != nil {
-							lss.logger.Errorw("Error decoding accrual response", "error", err, "order", orderNumber)
-						}
-						continue
-					}
-					resp.Body.Close()
-
-					if lss.logger != nil {
-						lss.logger.Infow("Received accrual response", "order", orderNumber, "status", accrualResponse.Status)
-					}
-
-					// Check if status is final
-					if accrualResponse.Status == "PROCESSED" || accrualResponse.Status == "INVALID" {
-						if accrualResponse.Status == "PROCESSED" && accrualResponse.Accrual != nil {
-							// Update both status and accrual
-							if err := lss.UpdateOrderStatusAndAccrual(ctx, orderNumber, accrualResponse.Status, accrualResponse.Accrual); err != nil {
-								if lss.logger != nil {
-									lss.logger.Errorw("Error updating order status and accrual", "error", err, "order", orderNumber)
-								}
-							}
-						} else {
-							// Update only status (for INVALID or PROCESSED)
-							if err := lss.UpdateOrderStatus(ctx, orderNumber, accrualResponse.Status); err != nil {
-								if lss.logger != nil {
-									lss.logger.Errorw("Error updating order status", "error", err, "order", orderNumber)
-								}
-							}
-						}
-
-						if lss.logger != nil {
-							lss.logger.Infow("Order reached final status", "order", orderNumber, "status", accrualResponse.Status)
-						}
-
-						return
-					}
-
-					// For non-final statuses continue polling
-					continue
-
-				case http.StatusNoContent:
-					resp.Body.Close()
-					if lss.logger != nil {
-						lss.logger.Debugw("Order not registered in accrual system yet", "order", orderNumber)
-					}
-					continue
-
-				case http.StatusTooManyRequests:
-					// Rate limited
-					retryAfter := 30 * time.Second
-					if retryAfterHeader := resp.Header.Get("Retry-After"); retryAfterHeader != "" {
-						if seconds, err := strconv.Atoi(retryAfterHeader); err == nil {
-							retryAfter = time.Duration(seconds) * time.Second
-						}
-					}
-
-					if lss.logger != nil {
-						lss.logger.Warnw("Rate limited by accrual system", "order", orderNumber, "retryAfter", retryAfter.String())
-					}
-
-					resp.Body.Close()
-					time.Sleep(retryAfter)
-					continue
-
-				default:
-					// Unexpected response, log and continue
-					if lss.logger != nil {
-						lss.logger.Errorw("Unexpected response from accrual system", "statusCode", resp.StatusCode, "order", orderNumber)
-					}
-					resp.Body.Close()
-					continue
-				}
-			}
+func (lss *LoyaltySystemService) RegisterCredential(ctx context.Context, username string, cred model.WebAuthnCredential) error {
+	return lss.repo.RegisterCredential(ctx, username, cred)
+}
+
+func (lss *LoyaltySystemService) GetCredentialsByUser(ctx context.Context, username string) ([]model.WebAuthnCredential, error) {
+	return lss.repo.GetCredentialsByUser(ctx, username)
+}
+
+func (lss *LoyaltySystemService) UpdateCredentialCounter(ctx context.Context, credentialID []byte, signCount uint32) error {
+	return lss.repo.UpdateCredentialCounter(ctx, credentialID, signCount)
+}
+
+func (lss *LoyaltySystemService) SaveWebAuthnSession(ctx context.Context, sessionID string, data []byte) error {
+	return lss.repo.SaveWebAuthnSession(ctx, sessionID, data)
+}
+
+func (lss *LoyaltySystemService) GetWebAuthnSession(ctx context.Context, sessionID string) ([]byte, error) {
+	return lss.repo.GetWebAuthnSession(ctx, sessionID)
+}
+
+func (lss *LoyaltySystemService) DeleteWebAuthnSession(ctx context.Context, sessionID string) error {
+	return lss.repo.DeleteWebAuthnSession(ctx, sessionID)
+}
+
+// LinkOrCreateFederatedUser resolves an OAuth2/OIDC identity to a username,
+// provisioning a federated-only account the first time it's seen.
+func (lss *LoyaltySystemService) LinkOrCreateFederatedUser(ctx context.Context, provider string, subject string, email string) (string, error) {
+	return lss.repo.LinkOrCreateFederatedUser(ctx, provider, subject, email)
+}
+
+// LinkFederatedIdentity attaches an OAuth2/OIDC identity to the already
+// authenticated username, so a password (or passkey) account can add a
+// social login without the unauthenticated email-matching path in
+// LinkOrCreateFederatedUser ever coming into play.
+func (lss *LoyaltySystemService) LinkFederatedIdentity(ctx context.Context, username string, provider string, subject string, email string) error {
+	return lss.repo.LinkFederatedIdentityToUser(ctx, username, provider, subject, email)
+}
+
+// randomRefreshToken generates an opaque 32-byte refresh token, the same way
+// oauth.go's randomState generates its state parameter.
+func randomRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashRefreshToken hashes a refresh token for storage, so a database leak
+// doesn't hand out usable tokens.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshSession mints and persists a new refresh token for username,
+// tied to the access token identified by accessJTI, and returns the raw
+// token for the caller to hand to the client.
+func (lss *LoyaltySystemService) IssueRefreshSession(ctx context.Context, username string, accessJTI string, userAgent string, ip string) (string, error) {
+	token, err := randomRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session := model.RefreshSession{
+		Username:  username,
+		TokenHash: hashRefreshToken(token),
+		AccessJTI: accessJTI,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(RefreshTokenTTL),
+		UserAgent: userAgent,
+		IP:        ip,
+	}
+	if err := lss.repo.CreateRefreshSession(ctx, session); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshSession redeems rawToken for a new refresh session tied to
+// newAccessJTI, revoking the old one. Presenting a token that was already
+// revoked is treated as a replay - the whole session chain for that user is
+// revoked instead of minting more tokens for whoever is replaying it.
+func (lss *LoyaltySystemService) RotateRefreshSession(ctx context.Context, rawToken string, newAccessJTI string, userAgent string, ip string) (string, string, error) {
+	hash := hashRefreshToken(rawToken)
+
+	session, err := lss.repo.GetRefreshSessionByHash(ctx, hash)
+	if err != nil {
+		return "", "", err
+	}
+	if session.RevokedAt != nil {
+		if revokeErr := lss.repo.RevokeAllRefreshSessions(ctx, session.Username); revokeErr != nil {
+			return "", "", revokeErr
 		}
-	}()
+		return "", "", apperrors.ErrRefreshTokenReused
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return "", "", apperrors.ErrRefreshTokenExpired
+	}
+
+	if err := lss.repo.RevokeRefreshSession(ctx, hash); err != nil {
+		return "", "", err
+	}
+
+	newToken, err := lss.IssueRefreshSession(ctx, session.Username, newAccessJTI, userAgent, ip)
+	if err != nil {
+		return "", "", err
+	}
+	return session.Username, newToken, nil
+}
+
+// RevokeRefreshSessionByToken ends the session for rawToken, used by logout.
+// It deletes the session outright rather than tombstoning it the way
+// RotateRefreshSession does: a deliberate logout isn't a stolen-token replay,
+// so presenting that token again afterwards shouldn't cascade-revoke the
+// user's other sessions - it should just look like a token that never
+// existed. A token that's already gone or unknown is not an error: logout
+// should succeed either way.
+func (lss *LoyaltySystemService) RevokeRefreshSessionByToken(ctx context.Context, rawToken string) error {
+	return lss.repo.DeleteRefreshSessionByHash(ctx, hashRefreshToken(rawToken))
+}
+
+// RevokeRefreshSessionByJTI revokes username's refresh session issued
+// alongside access-token jti, for a user revoking one session from their own
+// active-sessions list.
+func (lss *LoyaltySystemService) RevokeRefreshSessionByJTI(ctx context.Context, username string, jti string) error {
+	return lss.repo.RevokeRefreshSessionByJTI(ctx, username, jti)
+}
+
+// ListActiveRefreshSessions returns username's active (not revoked, not
+// expired) refresh sessions, for a sessions-audit view.
+func (lss *LoyaltySystemService) ListActiveRefreshSessions(ctx context.Context, username string) ([]model.RefreshSession, error) {
+	return lss.repo.ListActiveRefreshSessions(ctx, username)
+}
+
+// RevokeAccessJTI denylists an access token's jti so it stops being accepted
+// before its signature would naturally expire.
+func (lss *LoyaltySystemService) RevokeAccessJTI(ctx context.Context, jti string, expiresAt time.Time) error {
+	return lss.repo.RevokeAccessJTI(ctx, jti, expiresAt)
+}
+
+// IsAccessJTIRevoked reports whether jti has been denylisted by
+// RevokeAccessJTI.
+func (lss *LoyaltySystemService) IsAccessJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	return lss.repo.IsAccessJTIRevoked(ctx, jti)
 }